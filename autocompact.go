@@ -0,0 +1,136 @@
+package rkv
+
+import (
+	"time"
+)
+
+// DefaultCheckEvery used by CompactPolicy if CheckEvery is not set.
+const DefaultCheckEvery = time.Minute
+
+// CompactPolicy tells SafeRkv when to run CompactOnline on its own, see Options.Compaction.
+// Policy is evaluated every CheckEvery from live counters of the store.
+type CompactPolicy struct {
+	// DeadRatio is dead bytes divided by all bytes of data files, compaction runs
+	// once it is reached. Zero disables automatic compaction.
+	DeadRatio float64
+	MinSize   int64 // data files smaller than this in bytes are never compacted
+
+	// Compaction runs only between WindowStart and WindowEnd after local midnight,
+	// window may wrap past midnight, e.g. 22h to 6h. Any time if both are zero.
+	WindowStart time.Duration
+	WindowEnd   time.Duration
+
+	MinInterval time.Duration // minimal time between two runs
+	CheckEvery  time.Duration // how often policy is evaluated, DefaultCheckEvery if zero
+
+	Hook func(CompactRun) // called after every run, from the background goroutine
+}
+
+// CompactRun describes single run of automatic compaction.
+type CompactRun struct {
+	Start     time.Time
+	Duration  time.Duration
+	Reclaimed int64 // bytes of data files freed, writes during the run are subtracted
+	Err       error
+}
+
+// sizes returns bytes taken by records in all data files and bytes of dead records among them.
+func (kv *Rkv) sizes() (total, dead int64) {
+	total = kv.activeFile.cpos - kv.activeFile.dataStart()
+	for _, f := range kv.segments {
+		total += f.cpos - f.dataStart()
+	}
+	return total, total - kv.keydir.live
+}
+
+// due returns true if compaction should run at the time now with given sizes of data
+// files, last is the time of the previous run.
+func (p *CompactPolicy) due(total, dead int64, now, last time.Time) bool {
+	if p.DeadRatio <= 0 || total == 0 || total < p.MinSize {
+		return false
+	}
+	if float64(dead)/float64(total) < p.DeadRatio {
+		return false
+	}
+	if p.MinInterval > 0 && !last.IsZero() && now.Sub(last) < p.MinInterval {
+		return false
+	}
+	if p.WindowStart == p.WindowEnd {
+		return true
+	}
+	y, m, d := now.Date()
+	since := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	if p.WindowStart < p.WindowEnd {
+		return since >= p.WindowStart && since < p.WindowEnd
+	}
+	return since >= p.WindowStart || since < p.WindowEnd
+}
+
+// runCompact runs CompactOnline and reports it to the hook.
+func (kv *SafeRkv) runCompact() {
+	kv.mu.Lock()
+	before, _ := kv.Rkv.sizes()
+	kv.mu.Unlock()
+
+	run := CompactRun{Start: time.Now()}
+	run.Err = kv.CompactOnline()
+	run.Duration = time.Since(run.Start)
+
+	kv.mu.Lock()
+	after, _ := kv.Rkv.sizes()
+	kv.mu.Unlock()
+	run.Reclaimed = before - after
+
+	if run.Err != nil {
+		kv.opts.logf("rkv: automatic compaction failed: %v", run.Err)
+	}
+	if hook := kv.opts.Compaction.Hook; hook != nil {
+		hook(run)
+	}
+}
+
+// startAutoCompact starts background evaluation of Options.Compaction.
+func (kv *SafeRkv) startAutoCompact() {
+	p := &kv.opts.Compaction
+	if p.DeadRatio <= 0 || kv.opts.ReadOnly || kv.compactStop != nil {
+		return
+	}
+	every := p.CheckEvery
+	if every <= 0 {
+		every = DefaultCheckEvery
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	kv.compactStop, kv.compactDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		var last time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				kv.mu.Lock()
+				total, dead := kv.Rkv.sizes()
+				kv.mu.Unlock()
+				if p.due(total, dead, now, last) {
+					kv.runCompact()
+					last = time.Now()
+				}
+			}
+		}
+	}()
+}
+
+// stopAutoCompact stops background compaction and waits until running compaction is done.
+func (kv *SafeRkv) stopAutoCompact() {
+	if kv.compactStop == nil {
+		return
+	}
+	close(kv.compactStop)
+	<-kv.compactDone
+	kv.compactStop, kv.compactDone = nil, nil
+}
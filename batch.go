@@ -0,0 +1,156 @@
+package rkv
+
+import (
+	"time"
+)
+
+// WriteBatch holds changes in memory until they are applied with Write.
+// Zero value is an empty batch ready to use.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// batchOp is single change of the write batch. Values are encoded with codec of the
+// store by Write, unless they are raw already, nil raw value means delete.
+type batchOp struct {
+	key      string
+	v        interface{}
+	value    []byte
+	raw      bool
+	expire   int64 // expiry in Unix seconds, 0 if value never expires
+	compress bool  // compress value regardless of store options
+}
+
+// Put adds the key-value pair to the batch.
+func (b *WriteBatch) Put(key string, value interface{}) error {
+	return b.put(key, value, 0)
+}
+
+// PutForDays adds the key-value pair with expiration in future date to the batch.
+func (b *WriteBatch) PutForDays(key string, value interface{}, days int32) error {
+	return b.put(key, value, expireUnix(expireDays(days)))
+}
+
+// PutWithTTL adds the key-value pair expiring after ttl to the batch.
+func (b *WriteBatch) PutWithTTL(key string, value interface{}, ttl time.Duration) error {
+	return b.put(key, value, expireUnix(time.Now().Add(ttl)))
+}
+
+// PutUntil adds the key-value pair expiring at the given time to the batch.
+func (b *WriteBatch) PutUntil(key string, value interface{}, expire time.Time) error {
+	return b.put(key, value, expireUnix(expire))
+}
+
+// Delete adds deletion of the key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, raw: true})
+}
+
+// Len returns number of changes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset removes all changes from the batch, so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// put adds the key-value pair with expiration to the batch.
+func (b *WriteBatch) put(key string, value interface{}, expire int64) error {
+	if key == "" {
+		return ErrBlankKey
+	}
+	b.ops = append(b.ops, batchOp{key: key, v: value, expire: expire})
+	return nil
+}
+
+// putRaw adds the key with already encoded value to the batch.
+func (b *WriteBatch) putRaw(key string, value []byte) error {
+	if key == "" {
+		return ErrBlankKey
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	b.ops = append(b.ops, batchOp{key: key, value: value, raw: true})
+	return nil
+}
+
+// Write applies all changes of the batch at once. Batch is written with single
+// write call followed by commit record, if it is interrupted by a crash none of
+// the changes is visible when store is opened again.
+// Headerless version 1 files can not hold batches, changes are written one by one
+// there, use Upgrade to get atomic batches.
+func (kv *Rkv) Write(b *WriteBatch) error {
+	kv.isReady()
+	if kv.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	for i := range b.ops { // encode all values first, so nothing is written if any of them fails
+		op := &b.ops[i]
+		if !op.raw {
+			value, err := kv.marshal(op.v)
+			if err != nil {
+				return err
+			}
+			op.value, op.v, op.raw = value, nil, true
+		}
+	}
+	if err := kv.checkRollover(); err != nil {
+		return err
+	}
+
+	f := kv.activeFile
+	if f.version == 1 {
+		for _, op := range b.ops {
+			if err := kv.writeValue(op.key, op.value, op.expire, op.compress); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	hsz := recordHeaderSize(f.version)
+	vpos := make([]int64, len(b.ops))
+	vsz := make([]int64, len(b.ops))
+	klen := make([]int64, len(b.ops))
+	buff := []byte{}
+	for i, op := range b.ops {
+		stored, flags := kv.encodeValue(f, op.value, op.compress)
+		skey, stored, flags, err := kv.seal(f, op.key, stored, flags)
+		if err != nil {
+			return err
+		}
+		eflags, tstamp := encodeExpiry(f.version, op.expire)
+		klen[i], vsz[i] = int64(len(skey)), int64(len(stored))
+		vpos[i] = f.cpos + int64(len(buff)) + hsz + klen[i]
+		buff = append(buff, encodeRecord(f.version, skey, stored, flagBatch|flags|eflags, tstamp)...)
+	}
+	buff = append(buff, encodeRecord(f.version, "", nil, flagCommit, int64(len(b.ops)))...)
+
+	sz, err := f.file.Write(buff)
+	if err != nil {
+		f.file.Truncate(f.cpos) // do not leave partial batch behind
+		return err
+	}
+	f.cpos += int64(sz)
+	f.records += len(b.ops) + 1
+
+	kd := kv.keydir
+	for i, op := range b.ops {
+		if op.value == nil {
+			kd.remove(op.key)
+		} else {
+			kd.set(op.key, &KeydirEntry{gfile: f, vsz: vsz[i], vpos: vpos[i], klen: klen[i], tstamp: op.expire})
+		}
+	}
+	kv.countKeys()
+	if kv.opts.Sync == SyncAlways {
+		return f.file.Sync()
+	}
+	return nil
+}
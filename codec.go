@@ -0,0 +1,104 @@
+package rkv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+)
+
+// ErrRawValue is returned by RawCodec for values other than []byte and string.
+var ErrRawValue = errors.New("rkv: raw codec needs []byte or string value")
+
+// Codec encodes values stored with Put and decodes them for Get, see Options.Codec.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec stores values as JSON, this is the default.
+type JSONCodec struct{}
+
+// Marshal encodes v with encoding/json.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes data into v with encoding/json.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec stores values with encoding/gob, faster and smaller than JSON for structs.
+// Interface values have to be registered with gob.Register.
+type GobCodec struct{}
+
+// Marshal encodes v with encoding/gob.
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes data into v with encoding/gob.
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// RawCodec stores []byte and string values as they are. Get needs *[]byte or *string.
+type RawCodec struct{}
+
+// Marshal returns v if it is []byte or string, ErrRawValue otherwise.
+func (RawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case *[]byte:
+		return *v, nil
+	case string:
+		return []byte(v), nil
+	case *string:
+		return []byte(*v), nil
+	}
+	return nil, ErrRawValue
+}
+
+// Unmarshal copies data into v, which must be *[]byte or *string.
+func (RawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte{}, data...)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	}
+	return ErrRawValue
+}
+
+// codec returns codec of the store.
+func (kv *Rkv) codec() Codec {
+	if kv.opts.Codec != nil {
+		return kv.opts.Codec
+	}
+	return JSONCodec{}
+}
+
+// marshal encodes value with codec of the store. Result is never nil, nil is
+// used only for deleted keys.
+func (kv *Rkv) marshal(value interface{}) ([]byte, error) {
+	data, err := kv.codec().Marshal(value)
+	if data == nil && err == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+// jsonValues returns true if stored values are JSON, otherwise ExportJSON writes
+// them as base64 strings.
+func (kv *Rkv) jsonValues() bool {
+	_, ok := kv.codec().(JSONCodec)
+	return ok
+}
@@ -0,0 +1,126 @@
+package rkv
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Compaction writes live records into temporary file named after the target with "~"
+// appended, e.g. test.kv~. Temporary file is flushed to the disk and atomically renamed
+// over the target, so crash leaves either old or new file in place, never both half done.
+// Temporary files left by a crash are removed on open. Compacted file is marked with
+// featureCompacted, so older segments it replaces are dropped even if crash happens
+// before they are removed.
+
+// createCompacted creates temporary file for compaction into the file with the given name.
+func (kv *Rkv) createCompacted(name string, id int) (*GFile, error) {
+	file, err := os.OpenFile(name+"~", os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_RDWR, 0766)
+	if err != nil {
+		return nil, err
+	}
+	f := NewGFile(file)
+	f.id = id
+	f.features = featureCompacted
+	if err = f.initHeader(false, false); err != nil {
+		file.Close()
+		os.Remove(name + "~")
+		return nil, err
+	}
+	return f, nil
+}
+
+// abortCompacted closes and removes temporary file of f.
+func (kv *Rkv) abortCompacted(f *GFile) {
+	name := f.file.Name()
+	f.file.Close()
+	os.Remove(name)
+}
+
+// commitCompacted flushes temporary file of f and renames it to the given name.
+// File f is closed.
+func (kv *Rkv) commitCompacted(f *GFile, name string) error {
+	if err := f.file.Sync(); err != nil {
+		kv.abortCompacted(f)
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		os.Remove(name + "~")
+		return err
+	}
+	if err := os.Rename(name+"~", name); err != nil {
+		os.Remove(name + "~")
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir flushes directory entries, so renames and removals survive power loss.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil // directories can not be flushed there, renames are durable on their own
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeTemp removes temporary files of compaction and hint files left by a crash.
+func (kv *Rkv) removeTemp() error {
+	dir := filepath.Dir(kv.filename)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Base(kv.filename)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, "~") {
+			continue
+		}
+		if name != base+"~" && !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		kv.opts.logf("rkv: removing %s left by interrupted compaction", name)
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropStale closes sealed segments replaced by newer compacted file and removes
+// them unless the store is read-only. Such segments are left by a crash in the
+// middle of compaction.
+func (kv *Rkv) dropStale() error {
+	n := len(kv.segments)
+	if kv.activeFile.features&featureCompacted == 0 {
+		for n > 0 && kv.segments[n-1].features&featureCompacted == 0 {
+			n--
+		}
+		if n > 0 {
+			n-- // the compacted segment itself is kept
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	stale := kv.segments[:n]
+	kv.segments = append([]*GFile{}, kv.segments[n:]...)
+	if kv.opts.ReadOnly {
+		for _, f := range stale {
+			f.file.Close()
+		}
+		return nil
+	}
+	for _, f := range stale {
+		kv.opts.logf("rkv: removing %s replaced by compaction", f.file.Name())
+	}
+	return kv.removeSegments(stale)
+}
@@ -0,0 +1,92 @@
+package rkv
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// Compression tells Rkv how values are compressed before they are written.
+type Compression int
+
+const (
+	// CompressNone stores values as they are, this is the default.
+	CompressNone Compression = iota
+	// CompressFlate compresses values with compress/flate.
+	CompressFlate
+)
+
+// DefaultCompressMin used if Options.CompressMin is not set, shorter values are not worth compressing.
+const DefaultCompressMin = 128
+
+// Compressed values are flagged with flagFlate in the record header, so store may hold
+// both compressed and plain records and Compression may be changed at any time.
+// Values that do not shrink are stored as they are. Headerless version 1 files can not
+// flag records, values written there are never compressed.
+
+// encodeValue returns value as it should be stored in f and record flags describing it.
+// With force value is compressed regardless of store options.
+func (kv *Rkv) encodeValue(f *GFile, value []byte, force bool) ([]byte, uint32) {
+	if f.version == 1 || len(value) == 0 {
+		return value, 0
+	}
+	if !force {
+		min := kv.opts.CompressMin
+		if min <= 0 {
+			min = DefaultCompressMin
+		}
+		if kv.opts.Compression != CompressFlate || len(value) < min {
+			return value, 0
+		}
+	}
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression) // error only for invalid level
+	w.Write(value)
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return value, 0
+	}
+	return buf.Bytes(), flagFlate
+}
+
+// decodeValue returns original value of stored value with record flags.
+func decodeValue(value []byte, flags uint32) ([]byte, error) {
+	if flags&flagFlate == 0 {
+		return value, nil
+	}
+	r := flate.NewReader(bytes.NewReader(value))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// PutCompressed save the key-value pair in the current file same as Put, but value
+// is compressed even if store is not configured for compression.
+func (kv *Rkv) PutCompressed(key string, value interface{}) error {
+	kv.isReady()
+	if key == "" {
+		return ErrBlankKey
+	}
+
+	bytes, err := kv.marshal(value)
+	if err != nil {
+		return err
+	}
+	return kv.writeValue(key, bytes, 0, true)
+}
+
+// PutCompressed same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) PutCompressed(key string, value interface{}) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.PutCompressed(key, value)
+}
+
+// PutCompressed adds the key-value pair to the batch, value is compressed even
+// if store is not configured for compression.
+func (b *WriteBatch) PutCompressed(key string, value interface{}) error {
+	if err := b.put(key, value, 0); err != nil {
+		return err
+	}
+	b.ops[len(b.ops)-1].compress = true
+	return nil
+}
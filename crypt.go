@@ -0,0 +1,202 @@
+package rkv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// KeyProvider supplies AES keys of 16, 24 or 32 bytes for encryption, see Options.Keys.
+// Every encrypted record holds id of its key, so old keys have to stay available until
+// Compact rewrites records with the current key. Implementations must be goroutine safe.
+type KeyProvider interface {
+	CurrentKey() (id uint32, key []byte, err error) // key for new records
+	Key(id uint32) ([]byte, error)                  // key of existing records
+}
+
+// Keyring is simple KeyProvider holding all keys in memory. To rotate keys add new
+// key, make it Current and run Compact, then the old key may be dropped.
+type Keyring struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+// CurrentKey returns key with Current id.
+func (k *Keyring) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+// Key returns key with the given id, ErrWrongKey if there is no such key.
+func (k *Keyring) Key(id uint32) ([]byte, error) {
+	if key, ok := k.Keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrWrongKey
+}
+
+// Encrypted values and keys are stored as id of the key, nonce and AES-GCM sealed data:
+//
+//	| key id (uint32) | nonce ([12]byte) | sealed data with tag ([]byte) |
+//
+// Value is sealed with its plain key as additional data, so it can not be moved to
+// another key. Headerless version 1 files can not flag records, so they can not hold
+// encrypted records, use Upgrade first.
+
+const cryptHeaderSize = 4 + 12
+
+// aead returns AES-GCM cipher for the key with the given id.
+func (kv *Rkv) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	kv.aeadMu.Lock()
+	defer kv.aeadMu.Unlock()
+	if a := kv.aeads[id]; a != nil {
+		return a, nil
+	}
+	if key == nil {
+		if kv.opts.Keys == nil {
+			return nil, ErrWrongKey // store is encrypted, but no keys are given
+		}
+		var err error
+		if key, err = kv.opts.Keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if kv.aeads == nil {
+		kv.aeads = map[uint32]cipher.AEAD{}
+	}
+	kv.aeads[id] = a
+	return a, nil
+}
+
+// encrypt seals data with the current key.
+func (kv *Rkv) encrypt(data, extra []byte) ([]byte, error) {
+	id, key, err := kv.opts.Keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	a, err := kv.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, cryptHeaderSize, cryptHeaderSize+len(data)+a.Overhead())
+	binary.BigEndian.PutUint32(buf, id)
+	if _, err = io.ReadFull(rand.Reader, buf[4:cryptHeaderSize]); err != nil {
+		return nil, err
+	}
+	return a.Seal(buf, buf[4:cryptHeaderSize], data, extra), nil
+}
+
+// decrypt opens data sealed by encrypt, returns ErrWrongKey if key does not match.
+func (kv *Rkv) decrypt(data, extra []byte) ([]byte, error) {
+	if len(data) < cryptHeaderSize {
+		return nil, ErrWrongKey
+	}
+	a, err := kv.aead(binary.BigEndian.Uint32(data), nil)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := a.Open(nil, data[4:cryptHeaderSize], data[cryptHeaderSize:], extra)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return plain, nil
+}
+
+// seal returns key and value as they should be stored in f with flags describing them.
+// Nil value marks deleted key, it is stored as empty value without flags.
+func (kv *Rkv) seal(f *GFile, key string, value []byte, flags uint32) (string, []byte, uint32, error) {
+	if value != nil && len(value) == 0 {
+		flags |= flagEmpty
+	}
+	if kv.opts.Keys == nil && flags&flagEmpty == 0 {
+		return key, value, flags, nil
+	}
+	if f.version == 1 {
+		return "", nil, 0, ErrUnsupportedVersion
+	}
+	if kv.opts.Keys == nil {
+		return key, value, flags, nil
+	}
+	var err error
+	if len(value) > 0 {
+		if value, err = kv.encrypt(value, []byte(key)); err != nil {
+			return "", nil, 0, err
+		}
+		flags |= flagAES
+	}
+	if kv.opts.EncryptKeys {
+		skey, err := kv.encrypt([]byte(key), nil)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		key = string(skey)
+		flags |= flagKeyAES
+	}
+	return key, value, flags, nil
+}
+
+// store writes record of the key to f, key and value are encrypted if store is configured
+// so. Returns keydir entry of the record.
+func (kv *Rkv) store(f *GFile, key string, value []byte, flags uint32, expire int64) (*KeydirEntry, error) {
+	skey, svalue, flags, err := kv.seal(f, key, value, flags)
+	if err != nil {
+		return nil, err
+	}
+	kde := &KeydirEntry{gfile: f, klen: int64(len(skey)), tstamp: expire}
+	kde.vpos, kde.vsz, err = f.storeData(skey, svalue, flags, expire)
+	return kde, err
+}
+
+// openKey returns plain key of the record described by e.
+func (kv *Rkv) openKey(e hintEntry) (string, error) {
+	if e.flags&flagKeyAES == 0 {
+		return e.key, nil
+	}
+	key, err := kv.decrypt([]byte(e.key), nil)
+	return string(key), err
+}
+
+// openValue returns plain value of the key stored with flags, flagAES is removed from flags.
+func (kv *Rkv) openValue(key string, value []byte, flags uint32) ([]byte, uint32, error) {
+	if flags&flagAES == 0 {
+		return value, flags, nil
+	}
+	value, err := kv.decrypt(value, []byte(key))
+	if value == nil && err == nil {
+		value = []byte{} // empty value, nil would mean deleted key
+	}
+	return value, flags &^ flagAES, err
+}
+
+// checkKeys reads single live record of every file, so store opened with wrong key
+// fails with ErrWrongKey right away.
+func (kv *Rkv) checkKeys() error {
+	checked := map[*GFile]bool{}
+	for key, kde := range kv.keydir.keys {
+		if checked[kde.gfile] {
+			continue
+		}
+		checked[kde.gfile] = true
+		value, flags, err := kde.readRecord(key)
+		if err != nil {
+			continue // damaged record is handled by corruption policy once it is read
+		}
+		if _, _, err = kv.openValue(key, value, flags); err != nil {
+			return err
+		}
+		if len(checked) == len(kv.segments)+1 {
+			break
+		}
+	}
+	return nil
+}
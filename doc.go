@@ -15,10 +15,38 @@
 
     We use mostly same format but diverge in few aspects:
     1. If []byte value contains no data and is empty array, then it is deleted key, no data.
+        Since format version 2 empty values are flagged, so they are not mistaken for deleted keys.
     2. tstamp contains days or 0. If tstamp is not 0 and it is less than todays day, key record has expired.
         Use PutForDays to take advantage of automatic record expiration.
+        Since format version 2 records may hold expiry in Unix seconds instead, use PutWithTTL
+        or PutUntil for expiration with one second precision.
     3. Compact and AutoCompact reads database and compacts it.
-    4. Internally structs stored as JSON.
+    4. Internally structs stored as JSON by default, Options.Codec selects other encoding,
+        e.g. GobCodec or RawCodec for []byte and string values.
+    5. Crc of every record is verified on load and on read. Use NewWithOptions to choose
+        what happens with corrupted records, see CorruptionPolicy.
+    6. Since format version 2 files start with a header, tstamp and value length are 64 bit,
+        so files may grow past 2GB. Headerless version 1 files are still readable and writable,
+        Upgrade (or rkv upgrade tool) rewrites them in the current format version.
+    7. With Options.MaxFileSize active file is sealed once it grows too big, sealed segments
+        are kept next to it as test.kv.000001, test.kv.000002 etc. CompactSegments merges them.
+    8. Sealed segments and compacted files get hint files (test.kv.000001.hint) with keys and
+        value positions, so open does not have to read whole data files.
+    9. Compact and CompactSegments write into temporary file (test.kv~), flush it and rename it
+        over the original, crash in the middle leaves either old or new data, never lost data.
+        SafeRkv.CompactOnline merges segments while reads and writes continue.
+    10. With Options.Compression values are compressed with compress/flate, compressed records
+        are flagged, so stores with both compressed and plain records are readable.
+    11. With Options.Keys values (and keys with Options.EncryptKeys) are encrypted with AES-GCM,
+        Compact re-encrypts all records with the current key of the KeyProvider.
+    12. Store[T] is typed view of Rkv or SafeRkv, each type is kept under its own key prefix
+        and values that can not be decoded as T are reported as errors.
+    13. Keys are also kept in radix tree in memory, GetKeys, Iterator and ExportJSON list them
+        in ascending order, Range, RangeReverse and Seek scan them by range and
+        GetKeysWithPrefix finds keys by prefix without looking at other keys. ListKeys pages
+        through keys with cursor, which stays valid while the store changes.
+    14. Iter ranges over keys and values with for range, supports break, context cancellation
+        and filters and works with SafeRkv, channel based Iterator is deprecated.
 
     This is decent format for databases up to 50K records.
 */
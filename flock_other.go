@@ -0,0 +1,12 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package rkv
+
+import (
+	"os"
+)
+
+// lockFile is not supported on this platform, store is never locked.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,269 @@
+package rkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+   Files of format version 2 and later start with the file header:
+
+	|--------------------------------------------------|
+	| magic ([4]byte) | version (uint16) | flags (uint16) |
+	|--------------------------------------------------|
+
+   followed by the records:
+
+	|-------------------------------------------------------------------------------------------------|
+	| crc (uint32) | flags (uint32) | tstamp (int64) | key length (int32) | value length (int64) | ... |
+	|-------------------------------------------------------------------------------------------------|
+
+   Version 1 files have no header and use 32 bit fields for tstamp and lengths, see RecordHeaderSizeV1.
+   Crc covers everything in the record after the crc field itself.
+
+   Flags in the file header tell which optional features are used in the file, flags in
+   the record header describe the record. Files and records with flags unknown to this
+   version are refused with ErrUnsupportedFeature, so old code never misreads new data.
+
+   File written by Compact or CompactSegments has featureCompacted set, it holds all live
+   records of the older files of the store. Older segments left next to it by a crash
+   in the middle of compaction are stale, they are ignored and removed on open.
+
+   Tstamp of the record flagged with flagExpireUnix is its expiry time in Unix seconds,
+   otherwise it is the day number (Unix days) of the last day the record is valid.
+   Zero tstamp means the record never expires. Version 1 files can not flag records,
+   expiry is rounded up to the end of the day there.
+
+   Value of the record flagged with flagFlate is compressed, value length is its compressed length.
+   Value flagged with flagAES and key flagged with flagKeyAES are encrypted, see KeyProvider.
+   Value is compressed before it is encrypted.
+
+   Record with empty value marks deleted key, unless it is flagged with flagEmpty. Such
+   values are written by codecs like RawCodec and can not be stored in version 1 files.
+
+   Records of the write batch are flagged with flagBatch and followed by the commit record
+   with blank key, flagCommit and number of batch records in tstamp. Batch records without
+   commit record are ignored.
+
+   Hint file describes records of the data file without values, so keydir can be loaded
+   without reading the whole data file:
+
+	|----------------------------------------------------------------------|
+	| magic ([4]byte) | version (uint16) | flags (uint16) | data size (int64) |
+	|----------------------------------------------------------------------|
+	| flags (uint32) | tstamp (int64) | key length (int32) | value length (int64) | value position (int64) | key |
+	| ... one entry per record in the data file, in the same order                                           |
+	|---------------------------------------------------------------------------------------------------------|
+	| crc (uint32) |
+	|--------------|
+
+   Data size is the size of the data file covered by hint, records written after
+   the hint was created are read from the data file. Crc covers the whole hint file.
+*/
+
+const (
+	FormatVersion      uint16 = 2  // format version of newly created files
+	FileHeaderSize     int64  = 8  // size of the file header, version 2 and later
+	RecordHeaderSize   int64  = 28 // size of the record header, version 2 and later
+	RecordHeaderSizeV1 int64  = 16 // size of the record header in headerless version 1 files
+)
+
+const (
+	featureCompacted uint16 = 1 << 0 // file supersedes all older files of the store
+
+	flagBatch  uint32 = 1 << 0 // record is part of the write batch
+	flagCommit uint32 = 1 << 1 // commit record of the write batch, tstamp holds number of its records
+	flagExpire uint32 = 1 << 2 // tstamp holds expiry in Unix seconds instead of days
+	flagFlate  uint32 = 1 << 3 // value is compressed with compress/flate
+	flagAES    uint32 = 1 << 4 // value is encrypted with AES-GCM
+	flagKeyAES uint32 = 1 << 5 // key is encrypted with AES-GCM
+	flagEmpty  uint32 = 1 << 6 // value is empty, empty value without it marks deleted key
+
+	valueFlags uint32 = flagFlate | flagAES // flags describing how the value is stored
+
+	knownFeatures    uint16 = featureCompacted // file header flags understood by this version
+	knownRecordFlags uint32 = flagBatch | flagCommit | flagExpire | flagFlate | flagAES | flagKeyAES | flagEmpty
+)
+
+const (
+	hintVersion    uint16 = 2
+	hintHeaderSize        = 16
+	hintEntrySize         = 32
+)
+
+var (
+	fileMagic = []byte{'R', 'K', 'V', 0}   // starts every file of format version 2 and later
+	hintMagic = []byte{'R', 'K', 'V', 'H'} // starts every hint file
+)
+
+// hintEntry describes single record of the data file in the hint file.
+type hintEntry struct {
+	flags  uint32
+	tstamp int64
+	vsz    int64
+	vpos   int64
+	key    string
+}
+
+// recordHeader holds decoded record header, common for all format versions.
+type recordHeader struct {
+	crc    uint32
+	flags  uint32
+	tstamp int64
+	klen   int64
+	vlen   int64
+}
+
+// recordHeaderSize returns size of the record header in the file of the given format version.
+func recordHeaderSize(version uint16) int64 {
+	if version == 1 {
+		return RecordHeaderSizeV1
+	}
+	return RecordHeaderSize
+}
+
+// encodeExpiry returns record flags and tstamp holding expiry in Unix seconds
+// for the file of the given format version.
+func encodeExpiry(version uint16, expire int64) (flags uint32, tstamp int64) {
+	switch {
+	case expire == 0:
+		return 0, 0
+	case version == 1:
+		return 0, (expire - 1) / 86400 // last day the record is valid
+	}
+	return flagExpire, expire
+}
+
+// decodeExpiry returns expiry in Unix seconds of the record with given flags and tstamp,
+// zero if record never expires.
+func decodeExpiry(flags uint32, tstamp int64) int64 {
+	if tstamp == 0 || flags&flagExpire != 0 {
+		return tstamp
+	}
+	return (tstamp + 1) * 86400 // day records expire once the day is over
+}
+
+// encodeFileHeader returns file header for the given format version and feature flags.
+func encodeFileHeader(version, features uint16) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf, fileMagic)
+	binary.BigEndian.PutUint16(buf[4:], version)
+	binary.BigEndian.PutUint16(buf[6:], features)
+	return buf
+}
+
+// decodeFileHeader validates header of the file starting with buf and returns its
+// format version and feature flags. Files without magic are headerless version 1 files.
+func decodeFileHeader(buf []byte) (version, features uint16, err error) {
+	if len(buf) < int(FileHeaderSize) || !bytes.Equal(buf[:len(fileMagic)], fileMagic) {
+		return 1, 0, nil
+	}
+	version = binary.BigEndian.Uint16(buf[4:])
+	features = binary.BigEndian.Uint16(buf[6:])
+	if version < 2 || version > FormatVersion {
+		return 0, 0, ErrUnsupportedVersion
+	}
+	if features&^knownFeatures != 0 {
+		return 0, 0, ErrUnsupportedFeature
+	}
+	return version, features, nil
+}
+
+// encodeRecord returns record with key and value ready to be written into the file
+// of the given format version.
+func encodeRecord(version uint16, key string, value []byte, flags uint32, tstamp int64) []byte {
+	hsz := recordHeaderSize(version)
+	buf := make([]byte, hsz+int64(len(key))+int64(len(value)))
+	if version == 1 {
+		binary.BigEndian.PutUint32(buf[4:], uint32(tstamp))
+		binary.BigEndian.PutUint32(buf[8:], uint32(len(key)))
+		binary.BigEndian.PutUint32(buf[12:], uint32(len(value)))
+	} else {
+		binary.BigEndian.PutUint32(buf[4:], flags)
+		binary.BigEndian.PutUint64(buf[8:], uint64(tstamp))
+		binary.BigEndian.PutUint32(buf[16:], uint32(len(key)))
+		binary.BigEndian.PutUint64(buf[20:], uint64(len(value)))
+	}
+	copy(buf[hsz:], key)
+	copy(buf[hsz+int64(len(key)):], value)
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decodeRecordHeader decodes record header of the given format version.
+func decodeRecordHeader(version uint16, buf []byte) (h recordHeader) {
+	h.crc = binary.BigEndian.Uint32(buf)
+	if version == 1 {
+		h.tstamp = int64(int32(binary.BigEndian.Uint32(buf[4:])))
+		h.klen = int64(int32(binary.BigEndian.Uint32(buf[8:])))
+		h.vlen = int64(int32(binary.BigEndian.Uint32(buf[12:])))
+		return
+	}
+	h.flags = binary.BigEndian.Uint32(buf[4:])
+	h.tstamp = int64(binary.BigEndian.Uint64(buf[8:]))
+	h.klen = int64(int32(binary.BigEndian.Uint32(buf[16:])))
+	h.vlen = int64(binary.BigEndian.Uint64(buf[20:]))
+	return
+}
+
+// encodeHint returns hint file content for entries of the data file of the given size.
+func encodeHint(size int64, entries []hintEntry) []byte {
+	n := hintHeaderSize + 4
+	for _, e := range entries {
+		n += hintEntrySize + len(e.key)
+	}
+	buf := make([]byte, n)
+	copy(buf, hintMagic)
+	binary.BigEndian.PutUint16(buf[4:], hintVersion)
+	binary.BigEndian.PutUint64(buf[8:], uint64(size))
+
+	pos := hintHeaderSize
+	for _, e := range entries {
+		binary.BigEndian.PutUint32(buf[pos:], e.flags)
+		binary.BigEndian.PutUint64(buf[pos+4:], uint64(e.tstamp))
+		binary.BigEndian.PutUint32(buf[pos+12:], uint32(len(e.key)))
+		binary.BigEndian.PutUint64(buf[pos+16:], uint64(e.vsz))
+		binary.BigEndian.PutUint64(buf[pos+24:], uint64(e.vpos))
+		pos += hintEntrySize + copy(buf[pos+hintEntrySize:], e.key)
+	}
+	binary.BigEndian.PutUint32(buf[pos:], crc32.ChecksumIEEE(buf[:pos]))
+	return buf
+}
+
+// decodeHint returns entries and size of the data file covered by hint file content buf.
+func decodeHint(buf []byte) (size int64, entries []hintEntry, err error) {
+	n := len(buf) - 4
+	if n < hintHeaderSize || !bytes.Equal(buf[:len(hintMagic)], hintMagic) {
+		return 0, nil, errors.New("rkv: invalid hint file")
+	}
+	if binary.BigEndian.Uint32(buf[n:]) != crc32.ChecksumIEEE(buf[:n]) {
+		return 0, nil, errors.New("rkv: hint file checksum mismatch")
+	}
+	if version := binary.BigEndian.Uint16(buf[4:]); version != hintVersion {
+		return 0, nil, fmt.Errorf("rkv: unsupported hint version %d", version)
+	}
+	size = int64(binary.BigEndian.Uint64(buf[8:]))
+
+	for pos := hintHeaderSize; pos < n; {
+		if pos+hintEntrySize > n {
+			return 0, nil, errors.New("rkv: invalid hint file")
+		}
+		e := hintEntry{}
+		e.flags = binary.BigEndian.Uint32(buf[pos:])
+		e.tstamp = int64(binary.BigEndian.Uint64(buf[pos+4:]))
+		klen := int(binary.BigEndian.Uint32(buf[pos+12:]))
+		e.vsz = int64(binary.BigEndian.Uint64(buf[pos+16:]))
+		e.vpos = int64(binary.BigEndian.Uint64(buf[pos+24:]))
+		pos += hintEntrySize
+		if klen < 0 || pos+klen > n {
+			return 0, nil, errors.New("rkv: invalid hint file")
+		}
+		e.key = string(buf[pos : pos+klen])
+		pos += klen
+		entries = append(entries, e)
+	}
+	return size, entries, nil
+}
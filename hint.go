@@ -0,0 +1,90 @@
+package rkv
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// hintName returns name of the hint file for f.
+func (kv *Rkv) hintName(f *GFile) string {
+	if f.id == 0 {
+		return kv.filename + ".hint"
+	}
+	return kv.segmentName(f.id) + ".hint"
+}
+
+// loadHint reads hint file of f, which has the given size. Returns hint entries and
+// offset of the first record not covered by hint, ok is false if there is no valid hint.
+// Invalid hint file is removed, so it can not be mistaken for valid later.
+func (kv *Rkv) loadHint(f *GFile, size int64) (entries []hintEntry, end int64, ok bool) {
+	name := kv.hintName(f)
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	end, entries, err = decodeHint(buf)
+	if err == nil && (end < f.dataStart() || end > size || (f.id != 0 && end != size)) {
+		err = errors.New("rkv: hint file does not match data file")
+	}
+	if err != nil {
+		kv.opts.logf("rkv: ignoring hint file %s: %v", name, err)
+		if !kv.opts.ReadOnly {
+			os.Remove(name)
+		}
+		return nil, 0, false
+	}
+	return entries, end, true
+}
+
+// writeHint writes hint file with entries of f covering size bytes of the file.
+// Hint is only an optimization, so failure is logged and otherwise ignored.
+func (kv *Rkv) writeHint(f *GFile, entries []hintEntry, size int64) {
+	if kv.opts.ReadOnly {
+		return
+	}
+	name := kv.hintName(f)
+	temp := name + "~"
+	err := ioutil.WriteFile(temp, encodeHint(size, entries), 0666)
+	if err == nil {
+		err = os.Rename(temp, name)
+	}
+	if err != nil {
+		os.Remove(temp)
+		kv.opts.logf("rkv: can not write hint file %s: %v", name, err)
+	}
+}
+
+// scanHint reads all records of f and writes hint file for them.
+func (kv *Rkv) scanHint(f *GFile) {
+	stat, err := f.file.Stat()
+	if err != nil {
+		kv.opts.logf("rkv: can not write hint file %s: %v", kv.hintName(f), err)
+		return
+	}
+
+	entries := []hintEntry{}
+	rr := f.newRecordReader(f.dataStart(), stat.Size())
+	for {
+		hdr, vpos, key, err := rr.readRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			kv.opts.logf("rkv: can not write hint file %s: %v", kv.hintName(f), err)
+			return
+		}
+		entries = append(entries, hintEntry{flags: hdr.flags, tstamp: hdr.tstamp, vsz: hdr.vlen, vpos: vpos, key: string(key)})
+	}
+	kv.writeHint(f, entries, stat.Size())
+}
+
+// removeHint deletes hint file of f if there is one.
+func (kv *Rkv) removeHint(f *GFile) error {
+	if err := os.Remove(kv.hintName(f)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
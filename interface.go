@@ -1,7 +1,9 @@
 package rkv
 
 import (
+	"context"
 	"io"
+	"time"
 )
 
 // Interface only contains functions applicable to both Rkv and SafeRkv.
@@ -10,23 +12,36 @@ import (
 type Interface interface {
 	Reopen() error
 	Close()
+	Sync() error
 
 	Compact() error
 
 	GetKeys(with string, limit int) []string
+	GetKeysWithPrefix(prefix string, limit int) []string
+	ListKeys(with, cursor string, limit int) ([]string, string, error)
+	Range(start, end string, limit int) []string
+	RangeReverse(start, end string, limit int) []string
+	Seek(key string) (string, bool)
 	Get(key string, value interface{}) error
 	GetBytes(key string) ([]byte, error)
 
 	Put(key string, value interface{}) error
 	PutForDays(key string, value interface{}, days int32) error
+	PutWithTTL(key string, value interface{}, ttl time.Duration) error
+	PutUntil(key string, value interface{}, expire time.Time) error
 
 	Exist(key string) bool
 
 	Delete(key string) error
 	DeleteAllKeys(with string) error
+	DeleteKeysWithPrefix(prefix string) error
+
+	Write(b *WriteBatch) error
+
+	Stats() Stats
 
 	ExportJSON(w io.Writer) error
 	ImportJSON(r io.Reader) error
 
-	// Iterator(with string) chan<- string
+	Iter(ctx context.Context, opts IterOptions) *Iter
 }
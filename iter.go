@@ -0,0 +1,72 @@
+package rkv
+
+import (
+	"context"
+	"iter"
+)
+
+// IterOptions selects keys visited by Iter.
+type IterOptions struct {
+	Prefix string                // only keys starting with Prefix, found by prefix index
+	Filter func(key string) bool // only keys for which Filter returns true, all keys if nil
+}
+
+// Iter iterates over keys and values of the store in ascending key order, see
+// Rkv.Iter. Keys are taken when iteration starts, values are read one by one, so
+// the store may be changed while iterating, keys deleted meanwhile are skipped.
+type Iter struct {
+	kv   Interface
+	ctx  context.Context
+	opts IterOptions
+	err  error
+}
+
+// Iter returns iterator over keys selected by opts and their values, values are
+// encoded by codec of the store same as with GetBytes. Iteration stops once ctx is
+// done. Use Err to check why iteration stopped:
+//
+//	it := kv.Iter(ctx, rkv.IterOptions{Prefix: "user:"})
+//	for key, value := range it.All() {
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (kv *Rkv) Iter(ctx context.Context, opts IterOptions) *Iter {
+	return &Iter{kv: kv, ctx: ctx, opts: opts}
+}
+
+// All returns the iterator, breaking out of the loop stops it and nothing is left
+// running.
+func (it *Iter) All() iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		if it.err = it.ctx.Err(); it.err != nil {
+			return
+		}
+		for _, key := range it.kv.GetKeysWithPrefix(it.opts.Prefix, -1) {
+			if it.err = it.ctx.Err(); it.err != nil {
+				return
+			}
+			if it.opts.Filter != nil && !it.opts.Filter(key) {
+				continue
+			}
+			value, err := it.kv.GetBytes(key)
+			if err == ErrKeyNotFound {
+				continue // deleted or expired since iteration started
+			}
+			if err != nil {
+				it.err = err
+				return
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns error that stopped the last iteration, error of the context if it
+// was cancelled, nil if iteration finished or was stopped by the caller.
+func (it *Iter) Err() error {
+	return it.err
+}
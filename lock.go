@@ -0,0 +1,31 @@
+package rkv
+
+import (
+	"os"
+)
+
+// lock takes exclusive advisory lock of the store, so only one process writes it.
+// Lock is held on separate lock file, because active file is renamed on rollover.
+func (kv *Rkv) lock() error {
+	if kv.lockFile != nil {
+		return nil // already locked by this store
+	}
+	file, err := os.OpenFile(kv.filename+".lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	if err = lockFile(file); err != nil {
+		file.Close()
+		return err
+	}
+	kv.lockFile = file
+	return nil
+}
+
+// unlock releases the lock of the store, lock file itself is left in place.
+func (kv *Rkv) unlock() {
+	if kv.lockFile != nil {
+		kv.lockFile.Close()
+		kv.lockFile = nil
+	}
+}
@@ -0,0 +1,155 @@
+package rkv
+
+import (
+	"os"
+	"time"
+)
+
+// Online compaction merges sealed segments while the store keeps serving requests.
+// Active file is sealed first, so everything to compact is immutable. Live values
+// are copied into the merged segment without holding the lock, writes meanwhile
+// go to the new active file. Once copy is done the merged segment replaces sealed
+// ones and keydir entries not changed during the copy are moved to it; keys written
+// or deleted during the copy already point to the active file, so nothing is lost.
+
+// onlineCompaction holds state of the online compaction between its phases.
+type onlineCompaction struct {
+	segments []*GFile                // sealed segments being merged
+	entries  map[string]*KeydirEntry // keydir entries pointing to them when copy started
+	moved    map[string]*KeydirEntry // entries of merged segment, nil for dropped keys
+	merged   *GFile
+}
+
+// beginOnline seals the active file and takes snapshot of keydir entries to compact.
+// Returns nil if there is nothing to compact.
+func (kv *Rkv) beginOnline() (*onlineCompaction, error) {
+	kv.isReady()
+	if kv.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if kv.activeFile.cpos > kv.activeFile.dataStart() {
+		if err := kv.rollover(); err != nil {
+			return nil, err
+		}
+	}
+	if len(kv.segments) == 0 {
+		return nil, nil
+	}
+
+	oc := &onlineCompaction{
+		segments: append([]*GFile{}, kv.segments...),
+		entries:  map[string]*KeydirEntry{},
+		moved:    map[string]*KeydirEntry{},
+	}
+	sealed := map[*GFile]bool{}
+	for _, f := range oc.segments {
+		sealed[f] = true
+	}
+	for key, kde := range kv.keydir.keys {
+		if sealed[kde.gfile] {
+			oc.entries[key] = kde
+		}
+	}
+	last := oc.segments[len(oc.segments)-1]
+	merged, err := kv.createCompacted(kv.segmentName(last.id), last.id)
+	if err != nil {
+		return nil, err
+	}
+	oc.merged = merged
+	return oc, nil
+}
+
+// copyOnline writes live values of the snapshot into the merged segment. It only reads
+// sealed segments, so it runs without the lock.
+func (kv *Rkv) copyOnline(oc *onlineCompaction) error {
+	now := time.Now().Unix()
+	for key, kde := range oc.entries {
+		if kde.expired(now) {
+			oc.moved[key] = nil
+			continue
+		}
+		val, flags, err := kde.readRecord(key)
+		if cerr, ok := err.(*CorruptionError); ok {
+			if err = kv.corrupted(cerr); err == nil {
+				oc.moved[key] = nil // corrupted record is dropped
+				continue
+			}
+		}
+		if err == nil {
+			val, flags, err = kv.openValue(key, val, flags)
+		}
+		if err == nil {
+			oc.moved[key], err = kv.store(oc.merged, key, val, flags, kde.tstamp)
+		}
+		if err != nil {
+			kv.abortCompacted(oc.merged)
+			return err
+		}
+	}
+	return nil
+}
+
+// finishOnline replaces merged sealed segments with the merged segment and moves
+// keydir entries not changed since the snapshot to it.
+func (kv *Rkv) finishOnline(oc *onlineCompaction) error {
+	last := oc.segments[len(oc.segments)-1]
+	name := kv.segmentName(last.id)
+	if err := kv.removeHint(last); err != nil {
+		kv.abortCompacted(oc.merged)
+		return err
+	}
+	last.file.Close()
+	if err := kv.commitCompacted(oc.merged, name); err != nil {
+		last.file, _ = os.Open(name) // keep serving the old segment
+		return err
+	}
+	var err error
+	if oc.merged.file, err = os.Open(name); err != nil {
+		return err
+	}
+
+	for key, kde := range oc.moved {
+		if kv.keydir.keys[key] != oc.entries[key] {
+			continue // key was written or deleted during the copy
+		}
+		if kde == nil {
+			kv.keydir.remove(key)
+		} else {
+			kv.keydir.set(key, kde)
+		}
+	}
+	newer := kv.segments[len(oc.segments):] // sealed by rollover during the copy
+	kv.segments = append([]*GFile{oc.merged}, newer...)
+	err = kv.removeSegments(oc.segments[:len(oc.segments)-1])
+	kv.countKeys()
+	kv.lastCompact = time.Now()
+	return err
+}
+
+// CompactOnline merges sealed segments together with current active file into
+// single segment, dead and expired records are dropped. Unlike Compact the lock
+// is held only to seal the active file and to swap in the merged segment, reads
+// and writes continue while live values are copied.
+func (kv *SafeRkv) CompactOnline() error {
+	kv.compactMu.Lock()
+	defer kv.compactMu.Unlock()
+
+	kv.mu.Lock()
+	oc, err := kv.Rkv.beginOnline()
+	kv.mu.Unlock()
+	if oc == nil || err != nil {
+		return err
+	}
+
+	if err = kv.Rkv.copyOnline(oc); err != nil {
+		return err
+	}
+
+	kv.mu.Lock()
+	err = kv.Rkv.finishOnline(oc)
+	kv.mu.Unlock()
+	if err == nil {
+		kv.scanHint(oc.merged) // merged segment is immutable, hint is written without the lock
+	}
+	return err
+}
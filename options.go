@@ -0,0 +1,78 @@
+package rkv
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// CorruptionPolicy tells Rkv what to do with records that fail checksum verification.
+type CorruptionPolicy int
+
+const (
+	// CorruptFail returns *CorruptionError to the caller, this is the default.
+	CorruptFail CorruptionPolicy = iota
+	// CorruptSkip silently drops corrupted records.
+	CorruptSkip
+	// CorruptLog drops corrupted records and reports them with Options.Logger.
+	CorruptLog
+)
+
+// Options used to open Rkv store, zero value is valid and gives default behavior.
+type Options struct {
+	Corruption CorruptionPolicy // what to do with corrupted records
+	Logger     *log.Logger      // logger for CorruptLog and recovery, standard logger if nil
+
+	// Strict refuses to open store with incomplete last record left by a crash,
+	// by default such record is truncated and open succeeds.
+	Strict bool
+
+	// MaxFileSize in bytes, once active file grows past it the file is sealed as
+	// immutable segment and new active file is started. Zero keeps single file.
+	MaxFileSize int64
+
+	ReadOnly bool // open existing store for reading only, see NewReadOnly
+
+	// Compression of written values, values shorter than CompressMin bytes
+	// (DefaultCompressMin if zero) are stored as they are. See also PutCompressed.
+	Compression Compression
+	CompressMin int
+
+	Codec Codec // encoding of values, JSONCodec if nil
+
+	// Keys enables encryption of values with AES-GCM, with EncryptKeys keys are
+	// encrypted too. Store opened with wrong keys fails with ErrWrongKey.
+	Keys        KeyProvider
+	EncryptKeys bool
+
+	Sync      SyncMode      // when writes are flushed to the disk, see SyncMode
+	SyncEvery time.Duration // flush interval for SyncInterval, DefaultSyncEvery if zero
+
+	// SweepEvery makes SafeRkv remove expired keys in the background with this
+	// interval, see RemoveExpired. Zero disables the sweep, Rkv ignores it.
+	SweepEvery time.Duration
+
+	// Compaction makes SafeRkv compact the store in the background with CompactOnline,
+	// see CompactPolicy. Zero value disables it, Rkv ignores it.
+	Compaction CompactPolicy
+}
+
+// CorruptionError is returned when record read from the file fails checksum verification.
+type CorruptionError struct {
+	Filename string
+	Offset   int64  // file offset of the record header
+	Key      string // key of the corrupted record
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("rkv: corrupted record %q at offset %d in %s", e.Key, e.Offset, e.Filename)
+}
+
+// logf writes message to configured logger.
+func (opts *Options) logf(format string, v ...interface{}) {
+	if opts.Logger != nil {
+		opts.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
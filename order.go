@@ -0,0 +1,153 @@
+package rkv
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// Keydir keeps its keys in radix tree next to the map, so keys can be listed in
+// order, scanned by range and found by prefix without looking at other keys, see
+// radix.go. Tree is built once the store is loaded and then kept up to date by
+// set and remove.
+
+// buildIndex builds ordered index of the keys and keeps it up to date from now on.
+func (kd *Keydir) buildIndex() {
+	kd.index = new(radixTree)
+	for key := range kd.keys {
+		kd.index.insert(key)
+	}
+	kd.ordered = true
+}
+
+// sorted returns all keys in ascending order, including expired ones.
+func (kd *Keydir) sorted() []string {
+	keys := make([]string, 0, len(kd.keys))
+	kd.index.walk("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range returns up to limit keys from start (inclusive) to end (exclusive) in
+// ascending order, all of them if limit is negative. Empty end means no upper bound.
+func (kv *Rkv) Range(start, end string, limit int) []string {
+	kv.isReady()
+	keys := []string{}
+	now := time.Now().Unix()
+	kv.keydir.index.walk(start, func(key string) bool {
+		if len(keys) == limit || (end != "" && key >= end) {
+			return false
+		}
+		if !kv.keydir.keys[key].expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// RangeReverse returns up to limit keys from start (inclusive) to end (exclusive)
+// same as Range, but in descending order, so it starts with the last key before end.
+func (kv *Rkv) RangeReverse(start, end string, limit int) []string {
+	kv.isReady()
+	keys := []string{}
+	now := time.Now().Unix()
+	kv.keydir.index.walkReverse(end, func(key string) bool {
+		if len(keys) == limit || key < start {
+			return false
+		}
+		if !kv.keydir.keys[key].expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// Seek returns the first key equal to or greater than key, ok is false if there
+// is no such key.
+func (kv *Rkv) Seek(key string) (string, bool) {
+	keys := kv.Range(key, "", 1)
+	if len(keys) == 0 {
+		return "", false
+	}
+	return keys[0], true
+}
+
+// GetKeysWithPrefix returns up to limit keys starting with prefix in ascending
+// order, all of them if limit is negative. Unlike GetKeys, which matches keys
+// containing given string anywhere, only keys with the prefix are looked at.
+func (kv *Rkv) GetKeysWithPrefix(prefix string, limit int) []string {
+	kv.isReady()
+	keys := []string{}
+	now := time.Now().Unix()
+	kv.keydir.index.walkPrefix(prefix, func(key string) bool {
+		if len(keys) == limit {
+			return false
+		}
+		if !kv.keydir.keys[key].expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// ListKeys returns page of up to limit keys containing with in ascending order and
+// cursor of the next page, empty if there are no more keys. Empty cursor starts
+// with the first page. Page continues right after the last key of the previous
+// page, so keys written or deleted meanwhile do not shift pages. Negative limit
+// returns all remaining keys. Returns ErrInvalidCursor if cursor was not returned
+// by ListKeys.
+func (kv *Rkv) ListKeys(with, cursor string, limit int) (keys []string, next string, err error) {
+	kv.isReady()
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	keys = []string{}
+	now := time.Now().Unix()
+	kv.keydir.index.walk(after, func(key string) bool {
+		if cursor != "" && key == after {
+			return true
+		}
+		if kv.keydir.keys[key].expired(now) || (with != "" && !strings.Contains(key, with)) {
+			return true
+		}
+		if len(keys) == limit { // there is at least one more key
+			if limit > 0 {
+				next = encodeCursor(keys[len(keys)-1])
+			}
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	return keys, next, nil
+}
+
+// encodeCursor returns page cursor continuing after key.
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor returns key the page cursor continues after.
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || (cursor != "" && len(key) == 0) {
+		return "", ErrInvalidCursor
+	}
+	return string(key), nil
+}
+
+// DeleteKeysWithPrefix deletes all keys starting with prefix at once, see Write.
+func (kv *Rkv) DeleteKeysWithPrefix(prefix string) error {
+	kv.isReady()
+	b := new(WriteBatch)
+	for _, key := range kv.GetKeysWithPrefix(prefix, -1) {
+		b.Delete(key)
+	}
+	return kv.Write(b)
+}
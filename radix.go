@@ -0,0 +1,162 @@
+package rkv
+
+import (
+	"sort"
+	"strings"
+)
+
+// radixTree is set of keys kept in radix tree, keys sharing a prefix share the
+// path from the root, so keys with given prefix are found without looking at
+// other keys. Children are ordered by their labels, walks list keys in order.
+type radixTree struct {
+	root radixNode
+	size int
+}
+
+// radixNode is single node of the radix tree, its key is the concatenation of
+// labels on the path from the root.
+type radixNode struct {
+	label    string       // part of the key below the parent
+	leaf     bool         // key of the node is in the set
+	children []*radixNode // sorted by the first byte of their labels
+}
+
+// child returns index of the child starting with b and the child, nil child if
+// there is none and index where it belongs.
+func (n *radixNode) child(b byte) (int, *radixNode) {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].label[0] >= b })
+	if i < len(n.children) && n.children[i].label[0] == b {
+		return i, n.children[i]
+	}
+	return i, nil
+}
+
+// insert adds the key, returns false if it was already in the set.
+func (t *radixTree) insert(key string) bool {
+	n := &t.root
+	for key != "" {
+		i, child := n.child(key[0])
+		if child == nil {
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = &radixNode{label: key, leaf: true}
+			t.size++
+			return true
+		}
+		l := commonPrefix(key, child.label)
+		if l < len(child.label) { // key diverges inside the label, split it
+			split := &radixNode{label: child.label[:l], children: []*radixNode{child}}
+			child.label = child.label[l:]
+			n.children[i] = split
+			child = split
+		}
+		key = key[l:]
+		n = child
+	}
+	if n.leaf {
+		return false
+	}
+	n.leaf = true
+	t.size++
+	return true
+}
+
+// remove deletes the key, returns false if it was not in the set.
+func (t *radixTree) remove(key string) bool {
+	if !t.root.remove(key) {
+		return false
+	}
+	t.size--
+	return true
+}
+
+// remove deletes key relative to n, nodes left without a key or with single child
+// are merged, so the tree stays compact.
+func (n *radixNode) remove(key string) bool {
+	if key == "" {
+		if !n.leaf {
+			return false
+		}
+		n.leaf = false
+		return true
+	}
+	i, child := n.child(key[0])
+	if child == nil || !strings.HasPrefix(key, child.label) {
+		return false
+	}
+	if !child.remove(key[len(child.label):]) {
+		return false
+	}
+	if !child.leaf {
+		switch len(child.children) {
+		case 0:
+			n.children = append(n.children[:i], n.children[i+1:]...)
+		case 1:
+			merged := child.children[0]
+			merged.label = child.label + merged.label
+			n.children[i] = merged
+		}
+	}
+	return true
+}
+
+// walk calls fn for keys equal to or greater than start in ascending order
+// until fn returns false.
+func (t *radixTree) walk(start string, fn func(key string) bool) {
+	t.root.walk("", start, fn)
+}
+
+// walkPrefix calls fn for keys with the prefix in ascending order until fn
+// returns false.
+func (t *radixTree) walkPrefix(prefix string, fn func(key string) bool) {
+	t.walk(prefix, func(key string) bool {
+		return strings.HasPrefix(key, prefix) && fn(key)
+	})
+}
+
+// walkReverse calls fn for keys less than end in descending order until fn returns
+// false, empty end means all keys.
+func (t *radixTree) walkReverse(end string, fn func(key string) bool) {
+	t.root.walkReverse("", end, fn)
+}
+
+// walk visits keys of n and its children, key is the key of n. Subtrees with
+// all keys before start are skipped.
+func (n *radixNode) walk(key, start string, fn func(key string) bool) bool {
+	if key < start && !strings.HasPrefix(start, key) {
+		return true
+	}
+	if n.leaf && key >= start && !fn(key) {
+		return false
+	}
+	for _, child := range n.children {
+		if !child.walk(key+child.label, start, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkReverse visits keys of n and its children backwards, key is the key of n.
+// Subtrees with all keys after end are skipped.
+func (n *radixNode) walkReverse(key, end string, fn func(key string) bool) bool {
+	if end != "" && key >= end {
+		return true
+	}
+	for i := len(n.children) - 1; i >= 0; i-- {
+		child := n.children[i]
+		if !child.walkReverse(key+child.label, end, fn) {
+			return false
+		}
+	}
+	return !n.leaf || fn(key)
+}
+
+// commonPrefix returns length of the common prefix of a and b.
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
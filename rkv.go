@@ -3,7 +3,7 @@ package rkv
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"crypto/cipher"
 	"encoding/json"
     "encoding/csv"
 	"errors"
@@ -14,37 +14,52 @@ import (
 	"os"
 	"strings"
     "strconv"
+	"sync"
 	"time"
 )
 
 const (
-	/* Header offset for each record in the store.
-	This offset contains the following information (in the given order)
-	| -------------------------------------------------------------------------|
-	| crc (int32) | tstamp (int32) | key length (int32) | value length (int32) |
-	| -------------------------------------------------------------------------|
-	*/
-	RecordHeaderSize int32 = 16
-	MinCapKeys             = 1000
+	MinCapKeys = 1000
 )
 
 var (
 	ErrBlankKey    = errors.New("rkv: key can not be blank")
 	ErrKeyNotFound = errors.New("rkv: key not found")
     ErrInvalidKeyIndex = errors.New("rkv: key index is greater than number of fields")
+	ErrTornRecord  = errors.New("rkv: incomplete record at the end of file")
+	ErrNotRkvFile  = errors.New("rkv: not a rkv data file")
+	ErrLocked      = errors.New("rkv: store is locked by another process")
+	ErrReadOnly    = errors.New("rkv: store is open in read-only mode")
+	ErrUnsupportedVersion = errors.New("rkv: unsupported format version")
+	ErrUnsupportedFeature = errors.New("rkv: file uses unsupported features")
+	ErrWrongKey           = errors.New("rkv: wrong encryption key")
+	ErrInvalidCursor      = errors.New("rkv: invalid page cursor")
 )
 
 // Main structure for any Rkv file.
 // Holds the current directory and the active file
 type Rkv struct {
 	filename   string
+	opts       Options
 	activeFile *GFile
+	segments   []*GFile // sealed segments, oldest first
 	keydir     *Keydir
+	lockFile   *os.File // holds exclusive lock of the store
 
-	// values below are calculated only when store is open, they are not updated on Delete or Put
+	syncMu   sync.Mutex    // guards active file against background sync
+	syncStop chan struct{} // closed to stop background sync
+	syncDone chan struct{} // closed when background sync is stopped
+
+	lastCompact time.Time // end of the last compaction, see Stats
+
+	aeadMu sync.Mutex             // guards aeads, encryption is used by online compaction
+	aeads  map[uint32]cipher.AEAD // ciphers by key id
+
+	// values below are kept up to date by writes and compaction, see also Stats
 	FillRatio float64 // active records divided by dead-removed records, used for AutoCompact
 	CapKeys   int     // total number of keys = alive + dead
 	LenKeys   int     // number of keys = alive
+	Truncated int64   // bytes of incomplete last record discarded on open
 }
 
 // Make sure Rkv implements our common Interface
@@ -52,34 +67,56 @@ var _ Interface = (*Rkv)(nil)
 
 // GFile wrap a os.file and provide some convenient methods.
 type GFile struct {
-	file *os.File
-	cpos int32
+	file     *os.File
+	cpos     int64
+	version  uint16 // format version of the file
+	id       int    // id of the sealed segment, 0 for the active file
+	features uint16 // feature flags from the file header
+	records  int    // number of records in the file, alive and dead
 }
 
 // KeydirEntry entries in the keydir, which holds the location of any key in the key-store.
 type KeydirEntry struct {
 	gfile  *GFile
-	vsz    int32
-	vpos   int32
-	tstamp int64
+	vsz    int64
+	vpos   int64
+	klen   int64 // length of the key in the file, differs from the key if it is encrypted
+	tstamp int64 // expiry in Unix seconds, 0 if value never expires
 }
 
 // Keydir in memory structure that holds the location of all the keys in the key-value store.
 type Keydir struct {
 	keys map[string]*KeydirEntry
+	live int64 // bytes taken by records of the keys in data files
+
+	index   *radixTree // ordered index of the keys, see order.go
+	ordered bool       // index is built and kept up to date, false while store is loaded
 }
 
 // NewRkv open the key-value store at the given file.
 // If the file doesn't exist one will be created.
-// Always try to open for read-write, but if someone is already using this file, open in read-only mode.
+// Store is locked for writing, if another process is already using it ErrLocked is returned,
+// use NewReadOnly to read such store.
 // Populate the KeyDir structure with the information obtained from the data file.
 func New(filename string) (*Rkv, error) {
+	return NewWithOptions(filename, Options{})
+}
+
+// NewWithOptions open the key-value store at the given file same as New, but
+// allows to change default behavior with opts.
+func NewWithOptions(filename string, opts Options) (*Rkv, error) {
 	kv := new(Rkv)
-	kv.filename = filename
-	kv.FillRatio = 1
+	kv.init(filename, opts)
 	return kv.open()
 }
 
+// NewReadOnly open existing key-value store at the given file for reading only.
+// Store is not locked, so it can be read while another process writes it,
+// Put, Delete, Compact and other changes return ErrReadOnly.
+func NewReadOnly(filename string) (*Rkv, error) {
+	return NewWithOptions(filename, Options{ReadOnly: true})
+}
+
 // Reopen KV store.
 func (kv *Rkv) Reopen() error {
 	_, err := kv.open()
@@ -89,7 +126,18 @@ func (kv *Rkv) Reopen() error {
 // Close the key-value store.
 func (kv *Rkv) Close() {
 	kv.isReady()
+	kv.closeFiles()
+	kv.unlock()
+}
+
+// closeFiles closes all files of the store, but keeps the store locked.
+func (kv *Rkv) closeFiles() {
+	kv.stopSync()
+	kv.closeSegments()
 	if kv.activeFile != nil {
+		if kv.opts.Sync != SyncNever {
+			kv.activeFile.file.Sync()
+		}
 		kv.activeFile.file.Close()
 	}
 }
@@ -97,45 +145,90 @@ func (kv *Rkv) Close() {
 // AutoCompact auto compacts database once active records divided
 // by dead-removed records (fill ratio) drops below fillRatio
 // and there are enough alive and dead keys expressed as MinCapKeys.
+// See CompactPolicy for compaction running on its own in SafeRkv.
 func (kv *Rkv) AutoCompact(fillRatio float64) error {
+	kv.isReady()
+	kv.countKeys()
 	if kv.FillRatio < fillRatio && kv.CapKeys > MinCapKeys {
 		return kv.Compact()
 	}
 	return nil
 }
 
-// Compact database.
+// Compact database, all live records are written into new active file with their
+// expiry and sealed segments are removed. Expired records are dropped.
 func (kv *Rkv) Compact() error {
-	temp := kv.filename + "~"
-	compact, err := New(temp)
+	kv.isReady()
+	if kv.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	compact, err := kv.createCompacted(kv.filename, 0)
 	if err != nil {
 		return err
 	}
 
 	//kv.mu.Lock()
 	//defer kv.mu.Unlock()
-	kv.isReady()
+	now := time.Now().Unix()
 	for key, kde := range kv.keydir.keys {
-		val, err := kde.readValue()
-		if err != nil {
-			return err
+		if kde.expired(now) {
+			continue // expired values are dropped
+		}
+		val, flags, err := kv.readRaw(key, kde)
+		if err == ErrKeyNotFound {
+			continue // corrupted record was dropped
+		}
+		if err == nil {
+			_, err = kv.store(compact, key, val, flags, kde.tstamp) // keep compression and expiry, encrypt with current key
 		}
-		if err = compact.putRaw(key, val); err != nil {
+		if err != nil {
+			kv.abortCompacted(compact)
 			return err
 		}
 	}
-	kv.Close()
-	compact.Close()
+	segments := kv.segments
+	kv.closeFiles() // store stays locked
 
-	// move temp file and replace kv.filename
-	if err = os.Remove(kv.filename); err != nil {
+	// replace kv.filename with compacted file, segments left by a crash after
+	// the rename are stale and removed on open
+	if err = kv.removeHint(kv.activeFile); err != nil {
+		kv.abortCompacted(compact)
 		return err
 	}
-	if err = os.Rename(temp, kv.filename); err != nil {
+	if err = kv.commitCompacted(compact, kv.filename); err != nil {
 		return err
 	}
-	_, err = kv.open() // reopen database
-	return err
+	if err = kv.removeSegments(segments); err != nil {
+		return err
+	}
+	if _, err = kv.open(); err != nil { // reopen database
+		return err
+	}
+	kv.scanHint(kv.activeFile)
+	kv.lastCompact = time.Now()
+	return nil
+}
+
+// Version returns the oldest format version used by files of the store.
+func (kv *Rkv) Version() uint16 {
+	kv.isReady()
+	version := kv.activeFile.version
+	for _, f := range kv.segments {
+		if f.version < version {
+			version = f.version
+		}
+	}
+	return version
+}
+
+// Upgrade rewrites the store in the current format version with Compact if any of
+// its files uses older format version.
+func (kv *Rkv) Upgrade() error {
+	if kv.Version() < FormatVersion {
+		return kv.Compact()
+	}
+	return nil
 }
 
 // Put save the key-value pair in the current file.
@@ -145,30 +238,62 @@ func (kv *Rkv) Put(key string, value interface{}) error {
 		return ErrBlankKey
 	}
 
-	bytes, err := json.Marshal(value)
+	bytes, err := kv.marshal(value)
 	if err != nil {
 		return err
 	}
-	return kv.keydir.writeTo(kv.activeFile, key, bytes, 0)
+	return kv.write(key, bytes, 0)
 }
 
 // PutForDays save the key-value pair in the current file with expiration in future date.
-// Checking for expiration happens on database load, so only when database is
-// reopen records become expired.
+// Value expires once the given number of days after today is over, expired
+// keys are treated as missing and dropped on load and compaction.
 func (kv *Rkv) PutForDays(key string, value interface{}, days int32) error {
+	return kv.PutUntil(key, value, expireDays(days))
+}
+
+// PutWithTTL save the key-value pair in the current file, value expires after ttl.
+// Expired keys are treated as missing, same as for PutForDays.
+func (kv *Rkv) PutWithTTL(key string, value interface{}, ttl time.Duration) error {
+	return kv.PutUntil(key, value, time.Now().Add(ttl))
+}
+
+// PutUntil save the key-value pair in the current file, value expires at the given time.
+// Zero time means value never expires. Expiry has one second precision, in headerless
+// version 1 files it is rounded up to the end of the day.
+func (kv *Rkv) PutUntil(key string, value interface{}, expire time.Time) error {
 	kv.isReady()
 	if key == "" {
 		return ErrBlankKey
 	}
 
-	bytes, err := json.Marshal(value)
+	bytes, err := kv.marshal(value)
 	if err != nil {
 		return err
 	}
+	return kv.write(key, bytes, expireUnix(expire))
+}
 
-	seconds := time.Now().Unix()
-	futureDay := int32(seconds/86400) + days
-	return kv.keydir.writeTo(kv.activeFile, key, bytes, futureDay)
+// expireDays returns time when the given number of days after today is over.
+func expireDays(days int32) time.Time {
+	today := time.Now().Unix() / 86400
+	return time.Unix((today+int64(days)+1)*86400, 0)
+}
+
+// expireUnix returns expiry in Unix seconds, zero time means no expiry and gives 0.
+// Fractions of second are rounded up, so value never expires before t.
+func expireUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	sec := t.Unix()
+	if t.Nanosecond() > 0 {
+		sec++
+	}
+	if sec > 0 {
+		return sec
+	}
+	return 1 // times before 1970 are long expired, but 0 would mean no expiry
 }
 
 // Exist returns true if such key exist in the store already.
@@ -177,86 +302,90 @@ func (kv *Rkv) Exist(key string) bool {
 	//kv.mu.Lock()
 	//defer kv.mu.Unlock()
 
-	if kde := kv.keydir.keys[key]; kde == nil {
-		return false
-	}
-	return true
+	return kv.lookup(key) != nil
 }
 
 // Get retrieves the value for the given key from the keystore.
-// May return ErrKeyNotFound error if can not find such key in datastore.
+// May return ErrKeyNotFound error if can not find such key in datastore or it has expired.
+// Value is decoded with codec of the store, its errors are returned.
 func (kv *Rkv) Get(key string, value interface{}) error {
 	kv.isReady()
-	kde := kv.keydir.keys[key]
+	kde := kv.lookup(key)
 	if kde == nil {
 		return ErrKeyNotFound
-	} else {
-		bytes, err := kde.readValue()
-		if err != nil {
-			return err
-		}
-		json.Unmarshal(bytes, &value)
 	}
-	return nil
+	bytes, err := kv.readValue(key, kde)
+	if err != nil {
+		return err
+	}
+	return kv.codec().Unmarshal(bytes, value)
 }
 
-// GetBytes returns raw bytes from the database.
+// GetBytes returns raw bytes from the database, value as encoded by codec of the store.
 func (kv *Rkv) GetBytes(key string) ([]byte, error) {
 	kv.isReady()
-	kde := kv.keydir.keys[key]
+	kde := kv.lookup(key)
 	if kde == nil {
 		return nil, ErrKeyNotFound
 	}
-	return kde.readValue()
+	return kv.readValue(key, kde)
 }
 
 // Delete specific key.
 func (kv *Rkv) Delete(key string) error {
 	kv.isReady()
-	bytes := []byte{}
-	return kv.keydir.writeTo(kv.activeFile, key, bytes, 0)
+	return kv.write(key, nil, 0)
 }
 
-// DeleteAllKeys that match.
+// DeleteAllKeys that contain with, all keys are deleted at once, see Write.
+// See DeleteKeysWithPrefix for prefix match.
 func (kv *Rkv) DeleteAllKeys(with string) error {
 	kv.isReady()
-	for key, _ := range kv.keydir.keys {
+	b := new(WriteBatch)
+	now := time.Now().Unix()
+	for key, kde := range kv.keydir.keys {
+		if kde.expired(now) {
+			continue
+		}
 		if with == "" || strings.Contains(key, with) {
-			bytes := []byte{}
-			if err := kv.keydir.writeTo(kv.activeFile, key, bytes, 0); err != nil {
-				return err
-			}
+			b.Delete(key)
 		}
 	}
-	return nil
+	return kv.Write(b)
 }
 
-// Iterator returns iterator object (channel) of key values,
-// do not use in more than one goroutine.
+// Iterator returns iterator object (channel) of key values in ascending order,
+// keys are taken when it is created. Do not use in more than one goroutine.
+//
+// Deprecated: goroutine feeding the channel is left blocked if the caller stops
+// reading, use Iter instead.
 func (kv *Rkv) Iterator(with string) <-chan string {
 	kv.isReady()
 	iter := make(chan string, 1)
+	keys := kv.GetKeys(with, -1)
 	go func() {
-		for key, _ := range kv.keydir.keys {
-			if with == "" || strings.Contains(key, with) {
-				iter <- key
-			}
+		for _, key := range keys {
+			iter <- key
 		}
 		close(iter)
 	}()
 	return iter
 }
 
-// GetKeys returns limited number of keys matching criterio, if limit is
-// negative then returns all.
+// GetKeys returns limited number of keys containing with in ascending order,
+// if limit is negative then returns all. See GetKeysWithPrefix for prefix match.
 func (kv *Rkv) GetKeys(with string, limit int) []string {
 	kv.isReady()
 	keys := []string{}
 	count := 0
-	for key, _ := range kv.keydir.keys {
+	now := time.Now().Unix()
+	for _, key := range kv.keydir.sorted() {
 		if count == limit {
 			break
 		}
+		if kv.keydir.keys[key].expired(now) {
+			continue
+		}
 		if with == "" || strings.Contains(key, with) {
 			keys = append(keys, key)
 			count += 1
@@ -267,17 +396,71 @@ func (kv *Rkv) GetKeys(with string, limit int) []string {
 
 // ------ helpers ------
 
+// init sets up not yet opened KV store.
+func (kv *Rkv) init(filename string, opts Options) {
+	kv.filename = filename
+	kv.opts = opts
+	kv.FillRatio = 1
+}
+
 // open KV store.
 func (kv *Rkv) open() (ret *Rkv, err error) {
-	var activeFile *os.File
+	kv.stopSync()
 	kv.keydir = newKeydir()
-	activeFile, err = os.OpenFile(kv.filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0766)
+	if !kv.opts.ReadOnly {
+		if err = kv.lock(); err != nil {
+			return nil, err
+		}
+		if err = kv.removeTemp(); err != nil {
+			kv.unlock()
+			return nil, err
+		}
+	}
+	if err = kv.openSegments(); err != nil {
+		kv.unlock()
+		return nil, err
+	}
+	if err = kv.openActive(); err != nil {
+		kv.closeSegments()
+		kv.unlock()
+		return nil, err
+	}
+	if err = kv.dropStale(); err != nil {
+		kv.closeFiles()
+		kv.unlock()
+		return nil, err
+	}
+	if err = kv.populateKeyDir(); err == nil {
+		err = kv.checkKeys()
+	}
 	if err != nil {
+		kv.closeFiles()
+		kv.unlock()
 		return nil, err
 	}
-	kv.activeFile = NewGFile(activeFile)
-	err = kv.populateKeyDir()
-	return kv, err
+	kv.startSync()
+	return kv, nil
+}
+
+// openActive opens or creates the active file.
+func (kv *Rkv) openActive() error {
+	flag := os.O_CREATE | os.O_APPEND | os.O_RDWR
+	if kv.opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(kv.filename, flag, 0766)
+	if err != nil {
+		return err
+	}
+	f := NewGFile(file)
+	if err = f.initHeader(kv.opts.Strict, kv.opts.ReadOnly); err != nil {
+		file.Close()
+		return err
+	}
+	kv.syncMu.Lock()
+	kv.activeFile = f
+	kv.syncMu.Unlock()
+	return nil
 }
 
 // isReady checks if Rkv is open and ready.
@@ -292,20 +475,32 @@ func (kv *Rkv) isReady() {
 
 // ------ exports / imports ------
 
-// ExportJSON export all data from KV store as mixed JSON.
+// ExportJSON export all data from KV store as mixed JSON, keys in ascending order.
+// Values of stores with other codec than JSONCodec are exported as base64 strings.
 func (kv *Rkv) ExportJSON(w io.Writer) error {
 	kv.isReady()
 
 	count := 0
+	now := time.Now().Unix()
 	io.WriteString(w, "{\n")
-	for key, kde := range kv.keydir.keys {
-		if count > 0 {
-			io.WriteString(w, ",\n")
+	for _, key := range kv.keydir.sorted() {
+		kde := kv.keydir.keys[key]
+		if kde == nil || kde.expired(now) { // corrupted records are removed while reading
+			continue
+		}
+		val, err := kv.readValue(key, kde)
+		if err == ErrKeyNotFound {
+			continue // corrupted record was dropped
 		}
-		val, err := kde.readValue()
 		if err != nil {
 			return err
 		}
+		if val, err = kv.exportValue(val); err != nil {
+			return err
+		}
+		if count > 0 {
+			io.WriteString(w, ",\n")
+		}
 		io.WriteString(w, fmt.Sprintf(" \"%s\" : %s", key, val))
 		count += 1
 	}
@@ -336,11 +531,14 @@ func (kv *Rkv) exportKeys(w io.Writer, arr []string) error {
 		if count > 0 {
 			io.WriteString(w, ",\n")
 		}
-		kde := kv.keydir.keys[key]
+		kde := kv.lookup(key)
 		if kde == nil {
 			return ErrKeyNotFound
 		} else {
-			bytes, err := kde.readValue()
+			bytes, err := kv.readValue(key, kde)
+			if err == nil {
+				bytes, err = kv.exportValue(bytes)
+			}
 			if err != nil {
 				return err
 			}
@@ -354,20 +552,54 @@ func (kv *Rkv) exportKeys(w io.Writer, arr []string) error {
 }
 
 // ImportJSON imports files produced with ExportJSON function, may use os.Stdin.
+// Either all records are imported or none, see Write.
 func (kv *Rkv) ImportJSON(r io.Reader) error {
-	imp := make(map[string]interface{})
-	dat, err := ioutil.ReadAll(r)
+	b, err := kv.importJSON(r)
 	if err != nil {
 		return err
 	}
+	return kv.Write(b)
+}
+
+// importJSON reads file produced with ExportJSON into write batch, store is not touched.
+func (kv *Rkv) importJSON(r io.Reader) (*WriteBatch, error) {
+	dat, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(WriteBatch)
+	if !kv.jsonValues() {
+		imp := make(map[string][]byte) // base64 strings, see ExportJSON
+		if err := json.Unmarshal(dat, &imp); err != nil {
+			return nil, err
+		}
+		for key, val := range imp {
+			if err := b.putRaw(key, val); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
 
+	imp := make(map[string]interface{})
 	if err := json.Unmarshal(dat, &imp); err != nil {
-		return err
+		return nil, err
 	}
 	for key, val := range imp {
-		kv.Put(key, val)
+		if err := b.Put(key, val); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return b, nil
+}
+
+// exportValue returns stored value as it is written by ExportJSON.
+func (kv *Rkv) exportValue(value []byte) ([]byte, error) {
+	if kv.jsonValues() {
+		return value, nil
+	}
+	return json.Marshal(value)
 }
 
 
@@ -442,24 +674,74 @@ func (kv *Rkv) ImportCSV(r io.Reader, key int) error {
 
 // putRaw save the key-value pair in the current file.
 func (kv *Rkv) putRaw(key string, value []byte) error {
-	return kv.keydir.writeTo(kv.activeFile, key, value, 0)
+	return kv.write(key, value, 0)
+}
+
+// write save the key-value pair in the active file, active file is sealed first
+// if it grew past MaxFileSize.
+func (kv *Rkv) write(key string, value []byte, expire int64) error {
+	return kv.writeValue(key, value, expire, false)
+}
+
+// writeValue same as write, with compress value is compressed regardless of store options.
+func (kv *Rkv) writeValue(key string, value []byte, expire int64, compress bool) error {
+	if kv.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := kv.checkRollover(); err != nil {
+		return err
+	}
+	stored, flags := kv.encodeValue(kv.activeFile, value, compress)
+	kde, err := kv.store(kv.activeFile, key, stored, flags, expire)
+	if err != nil {
+		return err
+	}
+	if value == nil { // deleted key
+		kv.keydir.remove(key)
+	} else {
+		kv.keydir.set(key, kde)
+	}
+	kv.countKeys()
+	if kv.opts.Sync == SyncAlways {
+		return kv.activeFile.file.Sync()
+	}
+	return nil
 }
 
 // getRaw retrieves the value for the given if from the keystore.
 func (kv *Rkv) getRaw(key string) (value []byte, err error) {
-	kde := kv.keydir.keys[key]
+	kde := kv.lookup(key)
 	if kde == nil {
 		err = ErrKeyNotFound
 		value = nil
 	} else {
-		return kde.readValue()
+		return kv.readValue(key, kde)
 	}
 	return
 }
 
+// lookup returns keydir entry of the key, nil if there is no such key or it has expired.
+// Expired entries stay in the keydir until the store is compacted or reopened.
+func (kv *Rkv) lookup(key string) *KeydirEntry {
+	kde := kv.keydir.keys[key]
+	if kde == nil || kde.expired(time.Now().Unix()) {
+		return nil
+	}
+	return kde
+}
+
+// expired returns true if value of the entry has expired at the time now given in Unix seconds.
+func (kde *KeydirEntry) expired(now int64) bool {
+	return kde.tstamp != 0 && kde.tstamp <= now
+}
+
 // populateKeyDir read the contents at the given directory and load it into the memory.
 func (kv *Rkv) populateKeyDir() error {
-	return kv.fill()
+	if err := kv.fill(); err != nil {
+		return err
+	}
+	kv.keydir.buildIndex()
+	return nil
 }
 
 // fileExists return true if the given path exists and points to a valid file.
@@ -480,7 +762,83 @@ func ConvertToString(buff []byte) string {
 
 // NewGFile wrap the file f in an convenient structure.
 func NewGFile(f *os.File) *GFile {
-	return &GFile{f, 0}
+	return &GFile{file: f, version: FormatVersion}
+}
+
+// initHeader detects format version of the file from its header, empty file
+// gets the header of the current format version unless readOnly is set.
+// Header left incomplete by a crash is rewritten unless strict is set.
+func (f *GFile) initHeader(strict, readOnly bool) error {
+	stat, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() >= FileHeaderSize {
+		return f.readHeader()
+	}
+	if stat.Size() > 0 {
+		// crash while the file was created leaves only part of the header
+		buf := make([]byte, stat.Size())
+		if _, err = f.file.ReadAt(buf, 0); err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(encodeFileHeader(FormatVersion, 0), buf) {
+			return ErrNotRkvFile
+		}
+		if strict {
+			return ErrTornRecord
+		}
+	}
+	f.version = FormatVersion
+	f.cpos = f.dataStart()
+	if readOnly {
+		return nil
+	}
+	if err = f.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.file.Write(encodeFileHeader(f.version, f.features))
+	return err
+}
+
+// readHeader validates file header and detects format version of the file.
+// Headerless file has to start with valid version 1 record.
+func (f *GFile) readHeader() error {
+	buf := make([]byte, RecordHeaderSizeV1)
+	n, err := f.file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	f.version, f.features, err = decodeFileHeader(buf[:n])
+	if err != nil || f.version != 1 || n == 0 {
+		return err
+	}
+
+	stat, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := decodeRecordHeader(1, buf)
+	if int64(n) < RecordHeaderSizeV1 || hdr.klen <= 0 || hdr.vlen < 0 ||
+		RecordHeaderSizeV1+hdr.klen+hdr.vlen > stat.Size() {
+		return ErrNotRkvFile
+	}
+	rec := make([]byte, RecordHeaderSizeV1+hdr.klen+hdr.vlen)
+	if _, err = f.file.ReadAt(rec, 0); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(rec[4:]) != hdr.crc {
+		return ErrNotRkvFile
+	}
+	return nil
+}
+
+// dataStart returns offset of the first record in the file.
+func (f *GFile) dataStart() int64 {
+	if f.version == 1 {
+		return 0
+	}
+	return FileHeaderSize
 }
 
 // newKeydir instantiate an empty key dir.
@@ -492,102 +850,205 @@ func newKeydir() *Keydir {
 
 // storeData store the information on the file, update the current pos and return the position
 // and size of the value entry.
-func (f *GFile) storeData(key string, value []byte, expire int32) (vpos int32, vsz int32, err error) {
-	buff := new(bytes.Buffer)
-	keydata := []byte(key)
-	binary.Write(buff, binary.BigEndian, expire)
-	binary.Write(buff, binary.BigEndian, int32(len(keydata)))
-	binary.Write(buff, binary.BigEndian, int32(len(value)))
-	buff.Write(keydata)
-	buff.Write(value)
-
-	crc := crc32.ChecksumIEEE(buff.Bytes())
-
-	vpos = int32(f.cpos + RecordHeaderSize + int32(len(keydata)))
-	vsz = int32(len(value))
-	buff2 := new(bytes.Buffer)
-	binary.Write(buff2, binary.BigEndian, crc)
-	buff2.Write(buff.Bytes())
+// Flags describe the value, flags of expiry are added to them.
+func (f *GFile) storeData(key string, value []byte, flags uint32, expire int64) (vpos int64, vsz int64, err error) {
+	eflags, tstamp := encodeExpiry(f.version, expire)
+	buff := encodeRecord(f.version, key, value, flags|eflags, tstamp)
+	vpos = f.cpos + recordHeaderSize(f.version) + int64(len(key))
+	vsz = int64(len(value))
 	var sz int
-	sz, err = f.file.Write(buff2.Bytes())
-	vsz = int32(len(value))
-	f.cpos += int32(sz)
+	sz, err = f.file.Write(buff)
+	f.cpos += int64(sz)
+	f.records += 1
 	return vpos, vsz, err
 }
 
-// readHeader read the header structure from the file and return the header information.
-// If data could not be obtained return an errro (including an os.EOF error).
-func (f *GFile) readHeader() (crc, tstamp, klen, vlen, vpos int32, key []byte, err error) {
-	var hdrbuff []byte = make([]byte, RecordHeaderSize /* crc + tstamp + len key data + len value */)
-	var sz int
-	sz, err = f.file.Read(hdrbuff)
-
-	if err != nil {
-		return
+// set points the key to kde, record of replaced entry becomes dead.
+func (kd *Keydir) set(key string, kde *KeydirEntry) {
+	if old := kd.keys[key]; old != nil {
+		kd.live -= old.size(key)
+	} else if kd.ordered {
+		kd.index.insert(key)
 	}
+	kd.keys[key] = kde
+	kd.live += kde.size(key)
+}
 
-	if int32(sz) != RecordHeaderSize {
-		err = errors.New(fmt.Sprintf("Invalid header size. Expected %d got %d bytes", RecordHeaderSize, sz))
+// remove deletes the key, its record becomes dead.
+func (kd *Keydir) remove(key string) {
+	if kde := kd.keys[key]; kde != nil {
+		kd.live -= kde.size(key)
+		delete(kd.keys, key)
+		if kd.ordered {
+			kd.index.remove(key)
+		}
 	}
+}
+
+// size returns size of the whole record of the key in the data file.
+func (kde *KeydirEntry) size(key string) int64 {
+	return recordHeaderSize(kde.gfile.version) + kde.klen + kde.vsz
+}
 
-	buff := bufio.NewReader(bytes.NewBuffer(hdrbuff))
-	binary.Read(buff, binary.BigEndian, &crc)
-	binary.Read(buff, binary.BigEndian, &tstamp)
-	binary.Read(buff, binary.BigEndian, &klen)
-	binary.Read(buff, binary.BigEndian, &vlen)
+// recordReader reads records of the file one by one.
+type recordReader struct {
+	f    *GFile
+	r    *bufio.Reader
+	pos  int64 // offset of the next record
+	size int64 // size of the file
+}
 
-	key = make([]byte, klen)
-	sz, err = f.file.Read(key)
+// newRecordReader returns reader of the records in f starting at offset start,
+// records are read up to the given file size.
+func (f *GFile) newRecordReader(start, size int64) *recordReader {
+	r := bufio.NewReader(io.NewSectionReader(f.file, start, size-start))
+	return &recordReader{f, r, start, size}
+}
 
-	if err != nil {
+// readRecord read the next record from the file and return the record information.
+// If data could not be obtained return an errro (including an os.EOF error).
+// Record that does not fit into the file is reported as io.ErrUnexpectedEOF.
+// If record checksum does not match return *CorruptionError, reader position is
+// still moved to the next record, so reading may continue. Record with negative
+// lengths is reported as *CorruptionError too, but reader position is not moved.
+func (rr *recordReader) readRecord() (hdr recordHeader, vpos int64, key []byte, err error) {
+	f := rr.f
+	hsz := recordHeaderSize(f.version)
+	hdrbuff := make([]byte, hsz)
+	if _, err = io.ReadFull(rr.r, hdrbuff); err != nil {
 		return
 	}
 
-	if int32(sz) != klen {
-		err = errors.New(fmt.Sprintf("Invalid key size. Expected %d got %d bytes", klen, sz))
+	hdr = decodeRecordHeader(f.version, hdrbuff)
+	if hdr.klen < 0 || hdr.vlen < 0 {
+		err = &CorruptionError{Filename: f.file.Name(), Offset: rr.pos} // position is not moved, record length is unknown
+		return
+	}
+	if rr.pos+hsz+hdr.klen+hdr.vlen > rr.size {
+		err = io.ErrUnexpectedEOF
 		return
 	}
 
-	f.file.Seek(int64(vlen), 1) /* move foward in the file to the next header (means skip the value) */
-	vpos = f.cpos + RecordHeaderSize + klen
-	f.cpos += int32(RecordHeaderSize + klen + vlen)
-	return
-}
+	data := make([]byte, hdr.klen+hdr.vlen)
+	if _, err = io.ReadFull(rr.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
 
-// writeTo save the key/value pair in the given file f and update the keydir structure.
-func (kd *Keydir) writeTo(f *GFile, key string, value []byte, expire int32) error {
-	kde := new(KeydirEntry)
-	var err error
+	offset := rr.pos
+	key = data[:hdr.klen]
+	vpos = rr.pos + hsz + hdr.klen
+	rr.pos += hsz + hdr.klen + hdr.vlen
 
-	if f == nil || f.file == nil {
-		panic("file is nil")
+	if crc32.Update(crc32.ChecksumIEEE(hdrbuff[4:]), crc32.IEEETable, data) != hdr.crc {
+		err = &CorruptionError{Filename: f.file.Name(), Offset: offset, Key: string(key)}
+	} else if hdr.flags&^knownRecordFlags != 0 {
+		err = ErrUnsupportedFeature
 	}
+	return
+}
 
-	kde.vpos, kde.vsz, err = f.storeData(key, value, expire)
+// checkRollover seals the active file if it grew past MaxFileSize.
+func (kv *Rkv) checkRollover() error {
+	if kv.opts.MaxFileSize > 0 && kv.activeFile.cpos >= kv.opts.MaxFileSize {
+		return kv.rollover()
+	}
+	return nil
+}
 
-	kde.gfile = f
-	kde.tstamp = 0
-	if len(value) == 0 {
-		delete(kd.keys, key)
-	} else {
-		kd.keys[key] = kde
+// fill populate the keydir structure with the information from sealed segments and active file.
+func (kv *Rkv) fill() error {
+	kv.Truncated = 0
+	for _, f := range kv.segments {
+		if _, err := kv.fillFrom(f); err != nil {
+			kv.countKeys()
+			return err
+		}
 	}
+	_, err := kv.fillFrom(kv.activeFile)
+	kv.countKeys()
 	return err
 }
 
-// fill populate the keydir structure with the information from the given file.
-// Scan the entire file looking for information.
-func (kv *Rkv) fill() (ret error) {
-	kd := kv.keydir
-	f := kv.activeFile
-	f.file.Seek(0, 0) /* place the cursor in the begin of the file */
-	count := 0
-	kv.LenKeys = 0
-	seconds := time.Now().Unix()
-	today := int32(seconds / 86400)
+// countKeys updates FillRatio, CapKeys and LenKeys from the keydir and record counts of the files.
+func (kv *Rkv) countKeys() {
+	count := kv.activeFile.records
+	for _, f := range kv.segments {
+		count += f.records
+	}
+	kv.FillRatio = 1
+	if count > 0 {
+		kv.FillRatio = float64(len(kv.keydir.keys)) / float64(count)
+	}
+	kv.CapKeys = count // total number of keys = alive + dead
+	kv.LenKeys = len(kv.keydir.keys)
+}
+
+// fillFrom populate the keydir structure with the information from the given file.
+// Records covered by valid hint file are taken from it, the rest of the file is scanned
+// looking for information. Returns number of records found.
+func (kv *Rkv) fillFrom(f *GFile) (count int, ret error) {
+	stat, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size()
+
+	ld := kv.newLoader(f)
+	start := f.dataStart()
+	hints, end, hinted := kv.loadHint(f, size)
+	if hinted {
+		start = end
+		for _, e := range hints {
+			if err = ld.add(e); err != nil {
+				return ld.count, err
+			}
+		}
+	}
 
+	var scanned []hintEntry // hint entries for sealed segment without hint file
+	rr := f.newRecordReader(start, size)
 	for {
-		_, tstamp, _, vsz, vpos, keydata, err := f.readHeader()
+		offset := rr.pos
+		hdr, vpos, keydata, err := rr.readRecord()
+
+		if _, ok := err.(*CorruptionError); ok && rr.pos == size {
+			err = io.ErrUnexpectedEOF // damaged last record is the result of interrupted write
+		}
+		if err == io.ErrUnexpectedEOF {
+			// record does not fit into the file, it is torn only if it is the last one
+			if f == kv.activeFile && f.nextRecord(offset+1, size) < 0 {
+				rr.pos = offset
+				ret = kv.truncateTail(offset, size)
+				break
+			}
+			// sealed segments are never written, so it is corruption as well as damaged
+			// record followed by valid ones
+			err = &CorruptionError{Filename: f.file.Name(), Offset: offset}
+			rr.pos = offset
+		}
+		if cerr, ok := err.(*CorruptionError); ok && rr.pos == offset {
+			// length of the record is unknown, reading continues with the next valid record
+			if ret = kv.corrupted(cerr); ret != nil {
+				break
+			}
+			next := f.nextRecord(offset+1, size)
+			if next < 0 {
+				break
+			}
+			ld.count += 1
+			rr = f.newRecordReader(next, size)
+			continue
+		}
+
+		if cerr, ok := err.(*CorruptionError); ok {
+			if err = kv.corrupted(cerr); err == nil {
+				ld.count += 1 // skip corrupted record, it is dead
+				continue
+			}
+		}
 
 		if err != nil && err != io.EOF {
 			ret = err
@@ -596,43 +1057,181 @@ func (kv *Rkv) fill() (ret error) {
 			break
 		}
 
-		key := string(keydata)
-		kde := new(KeydirEntry)
-		kde.vpos = vpos
-		kde.vsz = vsz
-		kde.tstamp = 0
-		kde.gfile = f
+		e := hintEntry{flags: hdr.flags, tstamp: hdr.tstamp, vsz: hdr.vlen, vpos: vpos, key: string(keydata)}
+		if ret = ld.add(e); ret != nil {
+			break
+		}
+		if !hinted && f != kv.activeFile {
+			scanned = append(scanned, e)
+		}
+	}
+	f.cpos = rr.pos
+	f.records = ld.count
 
-		if vsz == 0 { // this is deleted value
-			delete(kd.keys, key)
-		} else if tstamp != 0 && tstamp < today { // this value has expired
-			delete(kd.keys, key)
-		} else {
-			kd.keys[key] = kde
+	if ld.batch != nil && f == kv.activeFile && ret == nil {
+		// batch without commit record is the result of interrupted write
+		f.cpos = ld.batchStart
+		ret = kv.truncateTail(ld.batchStart, size)
+	}
+	if !hinted && f != kv.activeFile && ret == nil {
+		kv.writeHint(f, scanned, size)
+	}
+	return ld.count, ret
+}
+
+// loader applies records of the file to the keydir, records of the write batch
+// are applied only once commit record of the batch is found.
+type loader struct {
+	kv         *Rkv
+	f          *GFile
+	now        int64 // current time in Unix seconds, for expiration
+	count      int         // number of records found
+	batch      []hintEntry // records of the batch waiting for commit
+	batchStart int64       // offset of the first record of the batch
+}
+
+// newLoader returns loader of records of f.
+func (kv *Rkv) newLoader(f *GFile) *loader {
+	return &loader{kv: kv, f: f, now: time.Now().Unix()}
+}
+
+// add applies single record described by e.
+func (ld *loader) add(e hintEntry) error {
+	ld.count += 1
+	switch {
+	case e.flags&flagBatch != 0:
+		if ld.batch == nil {
+			ld.batchStart = e.vpos - recordHeaderSize(ld.f.version) - int64(len(e.key))
 		}
-		count += 1
+		ld.batch = append(ld.batch, e)
+	case e.flags&flagCommit != 0:
+		if int64(len(ld.batch)) == e.tstamp { // commit record holds number of records in the batch
+			for _, b := range ld.batch {
+				if err := ld.kv.index(ld.f, b, ld.now); err != nil {
+					return err
+				}
+			}
+		}
+		ld.batch = nil
+	default:
+		ld.batch = nil // batch without commit record was never acknowledged
+		return ld.kv.index(ld.f, e, ld.now)
+	}
+	return nil
+}
 
-		if err == io.EOF {
-			break
+// index updates keydir with the record of f described by e.
+func (kv *Rkv) index(f *GFile, e hintEntry, now int64) error {
+	kd := kv.keydir
+	key, err := kv.openKey(e)
+	if err != nil {
+		return err
+	}
+	expire := decodeExpiry(e.flags, e.tstamp)
+	if e.vsz == 0 && e.flags&flagEmpty == 0 { // this is deleted value
+		kd.remove(key)
+	} else if expire != 0 && expire <= now { // this value has expired
+		kd.remove(key)
+	} else {
+		kd.set(key, &KeydirEntry{gfile: f, vsz: e.vsz, vpos: e.vpos, klen: int64(len(e.key)), tstamp: expire})
+	}
+	return nil
+}
+
+// nextRecord returns offset of the first valid record (header with sane lengths
+// and matching checksum) starting at or after from, -1 if there is none. Used to
+// tell damaged record in the middle of the file from torn record at its end.
+func (f *GFile) nextRecord(from, size int64) int64 {
+	if from >= size {
+		return -1
+	}
+	buf := make([]byte, size-from)
+	if n, _ := f.file.ReadAt(buf, from); int64(n) != size-from {
+		return -1
+	}
+	hsz := recordHeaderSize(f.version)
+	for p := int64(0); p+hsz <= int64(len(buf)); p++ {
+		hdr := decodeRecordHeader(f.version, buf[p:])
+		if hdr.klen < 0 || hdr.vlen < 0 || hdr.klen+hdr.vlen > int64(len(buf))-p-hsz {
+			continue
+		}
+		if crc32.ChecksumIEEE(buf[p+4:p+hsz+hdr.klen+hdr.vlen]) == hdr.crc {
+			return from + p
 		}
 	}
+	return -1
+}
 
-	kv.FillRatio = 1
-	if count > 0 {
-		kv.FillRatio = float64(len(kd.keys)) / float64(count)
+// truncateTail discards incomplete record at the end of the active file, which is
+// left by a crash in the middle of the write. In strict mode returns ErrTornRecord instead.
+func (kv *Rkv) truncateTail(offset, size int64) error {
+	f := kv.activeFile
+	if kv.opts.Strict {
+		return ErrTornRecord
 	}
-	kv.CapKeys = count // total number of keys = alive + dead
-	kv.LenKeys = len(kd.keys)
-	return ret
+	if kv.opts.ReadOnly {
+		return nil // writer may still be in the middle of the write
+	}
+	if err := f.file.Truncate(offset); err != nil {
+		return err
+	}
+	kv.Truncated = size - offset
+	kv.opts.logf("rkv: discarded %d bytes of incomplete record at the end of %s", kv.Truncated, f.file.Name())
+	return nil
+}
+
+// readValue reads value of the key and applies corruption policy if its record is damaged.
+// Returns ErrKeyNotFound if damaged record was dropped.
+func (kv *Rkv) readValue(key string, kde *KeydirEntry) ([]byte, error) {
+	value, flags, err := kv.readRaw(key, kde)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(value, flags)
+}
+
+// readRaw same as readValue, but returns decrypted value still compressed with flags describing it.
+func (kv *Rkv) readRaw(key string, kde *KeydirEntry) ([]byte, uint32, error) {
+	value, flags, err := kde.readRecord(key)
+	if cerr, ok := err.(*CorruptionError); ok {
+		if err = kv.corrupted(cerr); err == nil {
+			kv.keydir.remove(key)
+			return nil, 0, ErrKeyNotFound
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return kv.openValue(key, value, flags)
 }
 
-// readValue reads single value.
-func (kde *KeydirEntry) readValue() (value []byte, err error) {
-	value = make([]byte, kde.vsz)
+// corrupted applies corruption policy to cerr, returns nil if corrupted record should be skipped.
+func (kv *Rkv) corrupted(cerr *CorruptionError) error {
+	switch kv.opts.Corruption {
+	case CorruptSkip:
+		return nil
+	case CorruptLog:
+		kv.opts.logf("%v, record skipped", cerr)
+		return nil
+	}
+	return cerr
+}
+
+// readRecord reads single stored value with flags describing it and verifies checksum of the whole record.
+func (kde *KeydirEntry) readRecord(key string) (value []byte, flags uint32, err error) {
+	f := kde.gfile
+	hsz := recordHeaderSize(f.version)
+	klen := kde.klen
+	offset := kde.vpos - klen - hsz
+	buff := make([]byte, hsz+klen+kde.vsz)
 	var read int
-	read, err = kde.gfile.file.ReadAt(value, int64(kde.vpos))
-	if int32(read) != kde.vsz {
-		err = errors.New(fmt.Sprintf("Expected %d bytes got %d", kde.vsz, read))
+	read, err = f.file.ReadAt(buff, offset)
+	if read != len(buff) {
+		return nil, 0, errors.New(fmt.Sprintf("Expected %d bytes got %d", len(buff), read))
 	}
-	return
+	hdr := decodeRecordHeader(f.version, buff)
+	if hdr.crc != crc32.ChecksumIEEE(buff[4:]) || (hdr.flags&flagKeyAES == 0 && string(buff[hsz:hsz+klen]) != key) {
+		return nil, 0, &CorruptionError{Filename: f.file.Name(), Offset: offset, Key: key}
+	}
+	return buff[hsz+klen:], hdr.flags & valueFlags, nil
 }
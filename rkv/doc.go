@@ -13,5 +13,9 @@
 
        $ rkv test.kv < test.json
 
+       upgrade database files of older format version
+
+       $ rkv upgrade test.kv
+
 */
 package main
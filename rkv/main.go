@@ -18,6 +18,10 @@ var usage = `
 
   This will compact database and output to test.json.   
 
+  Example: $ rkv upgrade test.kv
+
+  This will rewrite database files of older format version into the current one.
+
 `
 
 var Usage = func() {
@@ -39,6 +43,10 @@ func main() {
 	flag.Parse()
 
 	dbfile := flag.Arg(0)
+	upgrade := dbfile == "upgrade"
+	if upgrade {
+		dbfile = flag.Arg(1)
+	}
 	if len(dbfile) == 0 {
 		log.Fatal("Missing db file name as first parameter with path to database file")
 	}
@@ -49,6 +57,15 @@ func main() {
 	}
 	defer kv.Close()
 
+	if upgrade {
+		version := kv.Version()
+		if err = kv.Upgrade(); err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Println("Database format version:", version, "upgraded to:", kv.Version())
+		return
+	}
+
 	if compact {
 		log.Println("Compacting...")
 		err = kv.Compact()
@@ -1,9 +1,20 @@
 package rkv
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -51,7 +62,7 @@ func OpenSafe(t *testing.T) Interface {
 
 func Close(t *testing.T, kv Interface) {
 	kv.Close()
-	os.Remove(testdb) // clean up after test execution
+	removeStore() // clean up after test execution
 }
 
 func Append(t *testing.T, kv Interface) {
@@ -109,7 +120,7 @@ func Append(t *testing.T, kv Interface) {
 	}
 
 	kv.Close()
-	os.Remove(testdb)
+	removeStore()
 }
 
 func ExportImport(t *testing.T, kv Interface) {
@@ -180,7 +191,7 @@ func ExportImport(t *testing.T, kv Interface) {
 
 	kv.Close()
 	os.Remove(testjson)
-	os.Remove(testdb)
+	removeStore()
 }
 
 func Fetch(t *testing.T, kv Interface) {
@@ -227,7 +238,7 @@ func Fetch(t *testing.T, kv Interface) {
 	}
 
 	kv.Close()
-	os.Remove(testdb)
+	removeStore()
 }
 
 func Iterator(t *testing.T, kv *Rkv) {
@@ -282,5 +293,1742 @@ func Iterator(t *testing.T, kv *Rkv) {
 	}
 
 	kv.Close()
-	os.Remove(testdb)
+	removeStore()
+}
+
+func TestCorruption(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	kv.Put("one", "first value")
+	kv.Put("two", "second value")
+	kv.Put("three", "third value")
+	kv.Close()
+
+	// flip single byte inside the value of key "two"
+	dat, err := ioutil.ReadFile(testdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(dat, []byte("second value"))
+	dat[pos] ^= 0xff
+	if err = ioutil.WriteFile(testdb, dat, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(testdb)
+	if cerr, ok := err.(*CorruptionError); !ok || cerr.Key != "two" {
+		t.Errorf("Expected corruption error for key \"two\", got %v", err)
+	}
+
+	kv, err = NewWithOptions(testdb, Options{Corruption: CorruptSkip})
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening with CorruptSkip", err.Error())
+	}
+	defer kv.Close()
+	if kv.Exist("two") {
+		t.Error("Corrupted key \"two\" should be skipped")
+	}
+	var val string
+	if err = kv.Get("three", &val); err != nil || val != "third value" {
+		t.Errorf("Expected \"third value\", got %q, error %v", val, err)
+	}
+
+	// corrupt value of already loaded key, Get has to notice it
+	f, err := os.OpenFile(testdb, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("X"), int64(bytes.Index(dat, []byte("third value"))))
+	f.Close()
+
+	kv.opts.Corruption = CorruptFail
+	if _, err = kv.GetBytes("three"); err == nil {
+		t.Error("Expected corruption error while reading key \"three\"")
+	}
+}
+
+func TestCorruptLength(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	for i := 0; i < 10; i++ {
+		kv.Put("key"+strconv.Itoa(i), "value "+strconv.Itoa(i))
+	}
+	kv.Close()
+
+	// value length of record in the middle points past the end of the file
+	dat, err := ioutil.ReadFile(testdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := bytes.Index(dat, []byte("key3")) - int(RecordHeaderSize)
+	dat[hdr+23] ^= 0x40
+	if err = ioutil.WriteFile(testdb, dat, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = New(testdb); err == nil {
+		t.Fatal("Expected corruption error, not truncation of valid records")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+	if stat, _ := os.Stat(testdb); stat.Size() != int64(len(dat)) {
+		t.Errorf("File size changed from %d to %d", len(dat), stat.Size())
+	}
+
+	kv, err = NewWithOptions(testdb, Options{Corruption: CorruptSkip})
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening with CorruptSkip", err.Error())
+	}
+	defer kv.Close()
+	if kv.Truncated != 0 || kv.LenKeys != 9 || kv.Exist("key3") {
+		t.Error("Only damaged record should be skipped, keys:", kv.LenKeys, "truncated:", kv.Truncated)
+	}
+	var val string
+	if err = kv.Get("key9", &val); err != nil || val != "value 9" {
+		t.Errorf("Expected \"value 9\", got %q, error %v", val, err)
+	}
+}
+
+func TestNegativeLength(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	for i := 0; i < 10; i++ {
+		kv.Put("key"+strconv.Itoa(i), "value "+strconv.Itoa(i))
+	}
+	kv.Close()
+
+	// key length of record in the middle is negative
+	dat, err := ioutil.ReadFile(testdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := bytes.Index(dat, []byte("key5")) - int(RecordHeaderSize)
+	dat[hdr+16] |= 0x80
+	if err = ioutil.WriteFile(testdb, dat, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = New(testdb); err == nil {
+		t.Fatal("Expected corruption error for negative length")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	kv, err = NewWithOptions(testdb, Options{Corruption: CorruptSkip})
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening with CorruptSkip", err.Error())
+	}
+	defer kv.Close()
+	if kv.LenKeys != 9 || kv.Exist("key5") || !kv.Exist("key6") {
+		t.Error("Only damaged record should be skipped, keys:", kv.LenKeys)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	kv.Put("one", "first value")
+	kv.Put("two", "second value")
+	kv.Close()
+
+	// simulate crash in the middle of writing last record
+	stat, _ := os.Stat(testdb)
+	os.Truncate(testdb, stat.Size()-3)
+
+	if _, err = NewWithOptions(testdb, Options{Strict: true}); err != ErrTornRecord {
+		t.Errorf("Expected ErrTornRecord in strict mode, got %v", err)
+	}
+
+	kv, err = New(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening database with torn tail", err.Error())
+	}
+	if kv.Truncated != stat.Size()-3-FileHeaderSize-RecordHeaderSize-int64(len("one"))-int64(len(`"first value"`)) {
+		t.Error("Wrong number of truncated bytes", kv.Truncated)
+	}
+	if kv.Exist("two") || !kv.Exist("one") {
+		t.Error("Only key \"one\" should survive the crash")
+	}
+	kv.Put("three", "third value")
+	kv.Close()
+
+	kv.Reopen()
+	defer kv.Close()
+	if kv.Truncated != 0 || kv.LenKeys != 2 {
+		t.Error("Database should be clean after recovery, keys:", kv.LenKeys, "truncated:", kv.Truncated)
+	}
+}
+
+func TestFormatV1(t *testing.T) {
+	defer removeStore()
+
+	// rkv/test.kv is created by the version 1 of the library
+	dat, err := ioutil.ReadFile("rkv/test.kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(testdb, dat, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening version 1 file", err.Error())
+	}
+	defer kv.Close()
+	if kv.Version() != 1 {
+		t.Error("Expected format version 1, got", kv.Version())
+	}
+	total := kv.LenKeys
+	if total == 0 {
+		t.Fatal("Version 1 file has no keys")
+	}
+	kv.Put("newkey", "appended in version 1 format")
+
+	if err = kv.Upgrade(); err != nil {
+		t.Fatalf("Error \"%q\" while upgrading", err.Error())
+	}
+	if kv.Version() != FormatVersion {
+		t.Error("Expected upgrade to format version", FormatVersion, "got", kv.Version())
+	}
+	var val string
+	if err = kv.Get("newkey", &val); err != nil || val != "appended in version 1 format" {
+		t.Errorf("Expected value of \"newkey\", got %q, error %v", val, err)
+	}
+	if kv.LenKeys != total+1 {
+		t.Error("Wrong number of keys after upgrade. Should be", total+1, "Found", kv.LenKeys)
+	}
+}
+
+func TestLargeOffsets(t *testing.T) {
+	removeStore()
+	defer removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	// continue writing past 2GB in a sparse file, version 1 offsets would overflow there
+	f := kv.activeFile
+	start := int64(math.MaxInt32) + 1000
+	if err = f.file.Truncate(start); err != nil {
+		t.Skip("Can not create sparse file:", err)
+	}
+	f.cpos = start
+	if err = kv.Put("far", "past 2GB"); err != nil {
+		t.Fatalf("Error \"%q\" while putting", err.Error())
+	}
+	b := new(WriteBatch)
+	b.Put("batch", 42)
+	if err = kv.Write(b); err != nil {
+		t.Fatalf("Error \"%q\" while writing batch", err.Error())
+	}
+
+	var val string
+	if err = kv.Get("far", &val); err != nil || val != "past 2GB" {
+		t.Errorf("Error \"%v\" reading value past 2GB, got %q", err, val)
+	}
+	var num int
+	if err = kv.Get("batch", &num); err != nil || num != 42 {
+		t.Errorf("Error \"%v\" reading batch value past 2GB, got %d", err, num)
+	}
+
+	entries := []hintEntry{}
+	for _, key := range []string{"far", "batch"} {
+		kde := kv.keydir.keys[key]
+		if kde.vpos <= math.MaxInt32 {
+			t.Errorf("Expected %s past 2GB, got position %d", key, kde.vpos)
+		}
+		entries = append(entries, hintEntry{vsz: kde.vsz, vpos: kde.vpos, key: key})
+	}
+	kv.writeHint(f, entries, f.cpos)
+	loaded, end, ok := kv.loadHint(f, f.cpos)
+	if !ok || end != f.cpos || len(loaded) != 2 {
+		t.Fatalf("Hint past 2GB is not loaded, end %d of %d", end, f.cpos)
+	}
+	for i, e := range loaded {
+		if e.vpos != entries[i].vpos || e.vsz != entries[i].vsz {
+			t.Errorf("Hint entry of %s has position %d, expected %d", e.key, e.vpos, entries[i].vpos)
+		}
+	}
+	kv.removeHint(f)
+}
+
+func TestFileHeader(t *testing.T) {
+	defer removeStore()
+
+	ioutil.WriteFile(testdb, []byte("arbitrary bytes, not a database file"), 0666)
+	if _, err := New(testdb); err != ErrNotRkvFile {
+		t.Error("Expected ErrNotRkvFile, got", err)
+	}
+
+	ioutil.WriteFile(testdb, []byte("RK"), 0666)
+	if kv, err := New(testdb); err != nil {
+		t.Error("Incomplete file header should be rewritten, got", err)
+	} else {
+		kv.Close()
+	}
+
+	ioutil.WriteFile(testdb, []byte{'R', 'K', 'V', 0, 0, 99, 0, 0}, 0666)
+	if _, err := New(testdb); err != ErrUnsupportedVersion {
+		t.Error("Expected ErrUnsupportedVersion, got", err)
+	}
+
+	ioutil.WriteFile(testdb, []byte{'R', 'K', 'V', 0, 0, 2, 0x80, 0}, 0666)
+	if _, err := New(testdb); err != ErrUnsupportedFeature {
+		t.Error("Expected ErrUnsupportedFeature, got", err)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	kv, err := NewWithOptions(testdb, Options{MaxFileSize: 512})
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer removeStore()
+
+	total := 100
+	for i := 0; i < total; i++ {
+		if err = kv.Put("key_"+strconv.Itoa(i), i); err != nil {
+			t.Errorf("Error \"%q\" while puting the key: \"%d\"", err.Error(), i)
+		}
+	}
+	// overwrite and delete some keys, so sealed segments have dead records
+	for i := 0; i < total; i += 2 {
+		kv.Put("key_"+strconv.Itoa(i), i*10)
+	}
+	for i := 1; i < total; i += 10 {
+		kv.Delete("key_" + strconv.Itoa(i))
+	}
+	if len(kv.segments) < 2 {
+		t.Fatal("Expected active file to roll over, segments:", len(kv.segments))
+	}
+
+	check := func(stage string) {
+		for i := 0; i < total; i++ {
+			var val int
+			err := kv.Get("key_"+strconv.Itoa(i), &val)
+			switch {
+			case i%10 == 1:
+				if err != ErrKeyNotFound {
+					t.Errorf("%s: deleted key_%d is still found", stage, i)
+				}
+			case i%2 == 0:
+				if err != nil || val != i*10 {
+					t.Errorf("%s: expected %d for key_%d, got %d, error %v", stage, i*10, i, val, err)
+				}
+			default:
+				if err != nil || val != i {
+					t.Errorf("%s: expected %d for key_%d, got %d, error %v", stage, i, i, val, err)
+				}
+			}
+		}
+	}
+
+	for _, f := range kv.segments {
+		if _, err := os.Stat(kv.hintName(f)); err != nil {
+			t.Error("Expected hint file for sealed segment", f.id)
+		}
+	}
+
+	kv.Close()
+	kv.Reopen()
+	check("reopen")
+
+	if err = kv.CompactSegments(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting segments", err.Error())
+	}
+	if len(kv.segments) != 1 {
+		t.Error("Expected single segment after CompactSegments, found", len(kv.segments))
+	}
+	check("compact segments")
+
+	kv.Close()
+	kv.Reopen()
+	check("reopen after compact segments")
+
+	if err = kv.Compact(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting", err.Error())
+	}
+	if ids, _ := kv.listSegments(); len(ids) != 0 || len(kv.segments) != 0 {
+		t.Error("Expected no segments after Compact, found", ids)
+	}
+	check("compact")
+	kv.Close()
+
+	// active file is loaded from the hint written by Compact and the rest is scanned
+	kv.Reopen()
+	kv.Put("extra", 1)
+	kv.Close()
+	kv.Reopen()
+	if !kv.Exist("extra") || kv.LenKeys != total-total/10+1 {
+		t.Error("Wrong number of keys loaded with hint file", kv.LenKeys)
+	}
+	kv.Close()
+
+	// damaged hint is ignored and removed
+	ioutil.WriteFile(kv.hintName(kv.activeFile), []byte("garbage"), 0666)
+	kv.Reopen()
+	if _, err := os.Stat(kv.hintName(kv.activeFile)); err == nil {
+		t.Error("Damaged hint file should be removed")
+	}
+	check("damaged hint")
+	kv.Close()
+}
+
+// removeStore deletes all store files created by the test: data, segment, hint and lock files.
+func removeStore() {
+	files, _ := filepath.Glob(testdb + "*")
+	for _, name := range files {
+		os.Remove(name)
+	}
+}
+
+func TestSync(t *testing.T) {
+	defer removeStore()
+
+	for _, opts := range []Options{
+		{Sync: SyncAlways},
+		{Sync: SyncAlways, MaxFileSize: 64}, // rollover flushes segments and directory
+		{Sync: SyncInterval, SyncEvery: time.Millisecond},
+	} {
+		removeStore()
+		kv, err := NewSafeWithOptions(testdb, opts)
+		if err != nil {
+			t.Fatal("Can not open database file")
+		}
+		for i := 0; i < 10; i++ {
+			if err = kv.Put("key_"+strconv.Itoa(i), i); err != nil {
+				t.Errorf("Error \"%q\" while puting the key: \"%d\"", err.Error(), i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err = kv.Sync(); err != nil {
+			t.Errorf("Error \"%q\" while syncing", err.Error())
+		}
+		kv.Close()
+
+		kv.Reopen()
+		if kv.LenKeys != 10 {
+			t.Error("Wrong number of keys after sync. Should be 10 Found", kv.LenKeys)
+		}
+		kv.Close()
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	kv.Put("gone", "deleted by batch")
+
+	b := new(WriteBatch)
+	b.Put("one", 1)
+	b.PutForDays("two", 2, 3)
+	b.Delete("gone")
+	if err = b.Put("", 0); err != ErrBlankKey {
+		t.Error("Expected ErrBlankKey for blank key in batch")
+	}
+	if err = kv.Write(b); err != nil {
+		t.Fatalf("Error \"%q\" while writing batch", err.Error())
+	}
+	kv.Close()
+
+	kv.Reopen()
+	if !kv.Exist("one") || !kv.Exist("two") || kv.Exist("gone") {
+		t.Error("Batch is not applied after reopen")
+	}
+
+	// simulate crash before commit record of the next batch is written
+	b.Reset()
+	b.Put("three", 3)
+	b.Delete("one")
+	kv.Write(b)
+	kv.Close()
+	stat, _ := os.Stat(testdb)
+	os.Truncate(testdb, stat.Size()-RecordHeaderSize)
+
+	kv.Reopen()
+	defer kv.Close()
+	if kv.Exist("three") || !kv.Exist("one") {
+		t.Error("Changes of incomplete batch should not be visible")
+	}
+	if kv.Truncated == 0 {
+		t.Error("Incomplete batch should be truncated")
+	}
+}
+
+func TestLocking(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	kv.Put("one", 1)
+
+	if _, err = New(testdb); err != ErrLocked {
+		t.Error("Expected ErrLocked while store is open for writing, got", err)
+	}
+
+	ro, err := NewReadOnly(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening read-only", err.Error())
+	}
+	var val int
+	if err = ro.Get("one", &val); err != nil || val != 1 {
+		t.Errorf("Expected 1 from read-only store, got %d, error %v", val, err)
+	}
+	if err = ro.Put("two", 2); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly from Put, got", err)
+	}
+	if err = ro.Delete("one"); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly from Delete, got", err)
+	}
+	if err = ro.Compact(); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly from Compact, got", err)
+	}
+	ro.Close()
+
+	kv.Close()
+	kv, err = New(testdb)
+	if err != nil {
+		t.Error("Store should be unlocked after Close, got", err)
+	} else {
+		kv.Close()
+	}
+
+	if _, err = NewReadOnly(testdb + "missing"); err == nil {
+		t.Error("Read-only open of missing store should fail")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	kv.PutWithTTL("hour", 1, time.Hour)
+	kv.PutWithTTL("past", 2, -time.Second)
+	kv.PutUntil("until", 3, time.Now().Add(-time.Minute))
+	kv.PutUntil("forever", 4, time.Time{})
+	kv.PutForDays("days", 5, 0)
+
+	b := new(WriteBatch)
+	b.PutWithTTL("batch", 6, time.Hour)
+	b.PutUntil("batchpast", 7, time.Now().Add(-time.Minute))
+	kv.Write(b)
+	kv.Close()
+
+	// append records with day expiry written by older versions
+	today := time.Now().Unix() / 86400
+	f, _ := os.OpenFile(testdb, os.O_WRONLY|os.O_APPEND, 0666)
+	f.Write(encodeRecord(FormatVersion, "oldvalid", []byte("8"), 0, today))
+	f.Write(encodeRecord(FormatVersion, "oldexpired", []byte("9"), 0, today-1))
+	f.Close()
+
+	kv.Reopen()
+	defer kv.Close()
+	for _, key := range []string{"hour", "forever", "days", "batch", "oldvalid"} {
+		if !kv.Exist(key) {
+			t.Errorf("Key %q should not expire yet", key)
+		}
+	}
+	for _, key := range []string{"past", "until", "batchpast", "oldexpired"} {
+		if kv.Exist(key) {
+			t.Errorf("Key %q should be expired", key)
+		}
+	}
+}
+
+func TestExpirySubSecond(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	if expireUnix(time.Unix(100, 1)) != 101 || expireUnix(time.Unix(100, 0)) != 100 {
+		t.Error("Expiry should be rounded up to whole seconds")
+	}
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	// deadline just before the next second, rounding down would expire it right away
+	deadline := time.Unix(time.Now().Unix()+1, 0).Add(-time.Nanosecond)
+	kv.PutUntil("until", 1, deadline)
+	b := new(WriteBatch)
+	b.PutUntil("batch", 2, deadline)
+	kv.Write(b)
+	NewStore[int](kv, "store:").PutUntil("until", 3, deadline)
+	if time.Now().Before(deadline) {
+		for _, key := range []string{"until", "batch", "store:until"} {
+			if !kv.Exist(key) {
+				t.Errorf("Key %s expired before its deadline", key)
+			}
+		}
+	}
+	time.Sleep(time.Until(deadline) + time.Millisecond)
+	if kv.Exist("until") || kv.Exist("batch") || kv.Exist("store:until") {
+		t.Error("Keys should expire right after their deadline")
+	}
+}
+
+func TestExpiryOnRead(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+	kv.Put("live", 1)
+	kv.PutWithTTL("hour", 2, time.Hour)
+	kv.PutUntil("gone", 3, time.Now().Add(-time.Second))
+
+	var val int
+	if kv.Exist("gone") {
+		t.Error("Expired key should not exist")
+	}
+	if err = kv.Get("gone", &val); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for expired key, got", err)
+	}
+	if _, err = kv.GetBytes("gone"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound from GetBytes for expired key, got", err)
+	}
+	if keys := kv.GetKeys("", -1); len(keys) != 2 {
+		t.Errorf("Expected 2 live keys, got %v", keys)
+	}
+	var buf bytes.Buffer
+	kv.ExportJSON(&buf)
+	if bytes.Contains(buf.Bytes(), []byte("gone")) {
+		t.Error("Expired key should not be exported")
+	}
+	if err = kv.Get("hour", &val); err != nil || val != 2 {
+		t.Errorf("Expected 2 for key with TTL, got %d, error %v", val, err)
+	}
+
+	if err = kv.Compact(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting", err.Error())
+	}
+	if _, ok := kv.keydir.keys["gone"]; ok {
+		t.Error("Expired key should be dropped by Compact")
+	}
+}
+
+func TestExpirySweep(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := NewSafeWithOptions(testdb, Options{SweepEvery: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	kv.Put("live", 1)
+	kv.PutWithTTL("gone", 2, -time.Second)
+
+	var left, lenKeys int
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		kv.mu.Lock()
+		left, lenKeys = len(kv.keydir.keys), kv.LenKeys
+		kv.mu.Unlock()
+		if left == 1 {
+			break
+		}
+	}
+	if left != 1 {
+		t.Errorf("Expected expired key to be swept, %d keys left", left)
+	}
+	if lenKeys != 1 {
+		t.Errorf("Expected LenKeys 1 after sweep, got %d", lenKeys)
+	}
+	kv.Close()
+
+	if kv.sweepStop != nil {
+		t.Error("Sweep should be stopped on Close")
+	}
+
+	plain, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not reopen database file")
+	}
+	defer plain.Close()
+	plain.PutUntil("gone", 3, time.Now().Add(-time.Second))
+	if n, err := plain.RemoveExpired(); n != 1 || err != nil {
+		t.Errorf("Expected 1 removed key, got %d, error %v", n, err)
+	}
+}
+
+func TestSweepReadOnly(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	until := time.Unix(time.Now().Unix()+2, 0)
+	kv.Put("live", 1)
+	kv.PutUntil("soon", 2, until)
+	kv.Close()
+
+	ro, err := NewReadOnly(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file read-only")
+	}
+	if n, err := ro.RemoveExpired(); n != 0 || err != nil {
+		t.Errorf("Expected nothing removed, got %d, error %v", n, err)
+	}
+	time.Sleep(time.Until(until))
+	if n, err := ro.RemoveExpired(); n != 1 || err != nil {
+		t.Errorf("Expected 1 removed key, got %d, error %v", n, err)
+	}
+	if err := ro.DeleteAllKeys("nothing"); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly deleting no keys, got", err)
+	}
+	if err := ro.DeleteKeysWithPrefix("nothing"); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly deleting no keys by prefix, got", err)
+	}
+	ro.Close()
+
+	var logged bytes.Buffer
+	logger := log.New(&logged, "", 0)
+	kv2, err := NewSafeWithOptions(testdb, Options{ReadOnly: true, SweepEvery: time.Millisecond, Logger: logger})
+	if err != nil {
+		t.Fatal("Can not open database file read-only")
+	}
+	time.Sleep(20 * time.Millisecond)
+	kv2.Close()
+	if logged.Len() != 0 {
+		t.Error("Unexpected sweep failure:", logged.String())
+	}
+}
+
+func TestSweepRace(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := NewSafeWithOptions(testdb, Options{SweepEvery: time.Millisecond})
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	// promoted Rkv functions would race with the sweep goroutine
+	for i := 0; i < 50; i++ {
+		kv.PutWithTTL("gone"+strconv.Itoa(i), i, -time.Second)
+		if err = kv.ImportJSON(strings.NewReader(`{"a": 1, "b": "two"}`)); err != nil {
+			t.Fatalf("Error \"%q\" while importing", err.Error())
+		}
+		if err = kv.ImportCSV(strings.NewReader("id,name\n1,one\n"), 0); err != nil {
+			t.Fatalf("Error \"%q\" while importing CSV", err.Error())
+		}
+		var buf bytes.Buffer
+		if err = kv.ExportKeysJSON(&buf, "a"); err != nil {
+			t.Fatalf("Error \"%q\" while exporting", err.Error())
+		}
+		if err = kv.ExportKeyJSON(&buf, "b"); err != nil {
+			t.Fatalf("Error \"%q\" while exporting", err.Error())
+		}
+		if kv.Version() != FormatVersion {
+			t.Fatal("Unexpected format version", kv.Version())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCompactExpiry(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := NewWithOptions(testdb, Options{MaxFileSize: 200})
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	until := time.Now().Add(time.Hour).Unix()
+	put := func() {
+		kv.Put("plain", 1)
+		kv.PutUntil("ttl", 2, time.Unix(until, 0))
+		kv.PutForDays("days", 3, 2)
+		kv.PutWithTTL("gone", 4, -time.Second)
+		for i := 0; i < 10; i++ {
+			kv.Put("filler"+strconv.Itoa(i), i)
+		}
+	}
+	check := func(name string) {
+		if kde := kv.keydir.keys["plain"]; kde == nil || kde.tstamp != 0 {
+			t.Errorf("%s: key without expiry should stay permanent", name)
+		}
+		if kde := kv.keydir.keys["ttl"]; kde == nil || kde.tstamp != until {
+			t.Errorf("%s: expiry of TTL key is not preserved", name)
+		}
+		if kde := kv.keydir.keys["days"]; kde == nil || kde.tstamp != expireUnix(expireDays(2)) {
+			t.Errorf("%s: expiry of PutForDays key is not preserved", name)
+		}
+		if _, ok := kv.keydir.keys["gone"]; ok {
+			t.Errorf("%s: expired key should be dropped", name)
+		}
+	}
+
+	put()
+	kv.Put("last", 0) // roll over, so the keys above are in sealed segments
+	if err = kv.CompactSegments(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting segments", err.Error())
+	}
+	check("CompactSegments")
+	kv.Reopen()
+	check("CompactSegments reopen")
+
+	put()
+	if err = kv.Compact(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting", err.Error())
+	}
+	check("Compact")
+	kv.Reopen()
+	check("Compact reopen")
+}
+
+func TestCompactCrash(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := NewWithOptions(testdb, Options{MaxFileSize: 100})
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	// saveSegments returns contents of sealed segments, so they can be restored
+	// to simulate crash before compaction removes them
+	saveSegments := func(skipLast bool) map[string][]byte {
+		saved := map[string][]byte{}
+		ids, _ := kv.listSegments()
+		if skipLast && len(ids) > 0 {
+			ids = ids[:len(ids)-1]
+		}
+		for _, id := range ids {
+			saved[kv.segmentName(id)], _ = ioutil.ReadFile(kv.segmentName(id))
+		}
+		return saved
+	}
+	restore := func(saved map[string][]byte) {
+		for name, data := range saved {
+			ioutil.WriteFile(name, data, 0666)
+		}
+		ioutil.WriteFile(testdb+"~", []byte("partial"), 0666)
+		ioutil.WriteFile(kv.segmentName(99)+"~", []byte("partial"), 0666)
+	}
+	check := func(name string) {
+		if kv.Exist("deleted") {
+			t.Errorf("%s: deleted key came back from stale segment", name)
+		}
+		for i := 0; i < 10; i++ {
+			if !kv.Exist("key" + strconv.Itoa(i)) {
+				t.Errorf("%s: key%d is lost", name, i)
+			}
+		}
+		if fileExists(testdb+"~") || fileExists(kv.segmentName(99)+"~") {
+			t.Errorf("%s: temporary files are not removed on open", name)
+		}
+	}
+
+	kv.Put("deleted", 0)
+	for i := 0; i < 10; i++ {
+		kv.Put("key"+strconv.Itoa(i), i)
+	}
+	kv.Delete("deleted")
+	saved := saveSegments(true)
+	if len(saved) < 2 {
+		t.Fatal("Expected several sealed segments")
+	}
+	if err = kv.CompactSegments(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting segments", err.Error())
+	}
+	kv.Close()
+	restore(saved)
+
+	ro, err := NewReadOnly(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening read-only", err.Error())
+	}
+	if ro.Exist("deleted") {
+		t.Error("Read-only: deleted key came back from stale segment")
+	}
+	ro.Close()
+	for name := range saved {
+		if !fileExists(name) {
+			t.Error("Read-only open should not remove stale segments")
+		}
+	}
+
+	kv.Reopen()
+	check("CompactSegments")
+	for name := range saved {
+		if fileExists(name) {
+			t.Errorf("Stale segment %s is not removed on open", name)
+		}
+	}
+
+	kv.Put("deleted", 0)
+	kv.Delete("deleted")
+	saved = saveSegments(false)
+	if err = kv.Compact(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting", err.Error())
+	}
+	kv.Close()
+	restore(saved)
+
+	kv.Reopen()
+	check("Compact")
+	if len(kv.segments) != 0 {
+		t.Errorf("Stale segments are not dropped after Compact, %d left", len(kv.segments))
+	}
+}
+
+func TestCompactOnline(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := NewSafeWithOptions(testdb, Options{MaxFileSize: 500})
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	for i := 0; i < 50; i++ {
+		kv.Put("key"+strconv.Itoa(i), i)
+	}
+	for i := 0; i < 50; i += 2 {
+		kv.Put("key"+strconv.Itoa(i), i*10) // leave dead records behind
+	}
+
+	// change keys between the phases, as if written while values are copied
+	oc, err := kv.Rkv.beginOnline()
+	if err != nil || oc == nil {
+		t.Fatal("Can not begin online compaction", err)
+	}
+	kv.Put("key1", -1)
+	kv.Delete("key3")
+	kv.Put("new", 1)
+	if err = kv.Rkv.copyOnline(oc); err != nil {
+		t.Fatalf("Error \"%q\" while copying", err.Error())
+	}
+	if err = kv.Rkv.finishOnline(oc); err != nil {
+		t.Fatalf("Error \"%q\" while finishing", err.Error())
+	}
+
+	// and once more with concurrent writers and readers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var val int
+		for i := 0; i < 200; i++ {
+			kv.Put("busy"+strconv.Itoa(i%20), i)
+			kv.Get("key"+strconv.Itoa(i%50), &val)
+		}
+	}()
+	if err = kv.CompactOnline(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting online", err.Error())
+	}
+	<-done
+
+	check := func(name string) {
+		var val int
+		for i := 0; i < 50; i++ {
+			key := "key" + strconv.Itoa(i)
+			want := i
+			if i%2 == 0 {
+				want = i * 10
+			}
+			switch i {
+			case 1:
+				want = -1
+			case 3:
+				if kv.Exist(key) {
+					t.Errorf("%s: key deleted during compaction is back", name)
+				}
+				continue
+			}
+			if err := kv.Get(key, &val); err != nil || val != want {
+				t.Errorf("%s: expected %d for %s, got %d, error %v", name, want, key, val, err)
+			}
+		}
+		if !kv.Exist("new") || !kv.Exist("busy19") {
+			t.Errorf("%s: keys written during compaction are lost", name)
+		}
+	}
+	check("CompactOnline")
+	if kv.segments[0].features&featureCompacted == 0 {
+		t.Error("Oldest segment should be the merged one")
+	}
+	kv.Reopen()
+	check("CompactOnline reopen")
+	kv.Close()
+}
+
+func TestCompactPolicy(t *testing.T) {
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	at := func(h int) time.Time { return day.Add(time.Duration(h) * time.Hour) }
+
+	p := CompactPolicy{DeadRatio: 0.5, MinSize: 100}
+	if p.due(1000, 400, at(12), time.Time{}) {
+		t.Error("Should not compact below dead ratio")
+	}
+	if p.due(90, 80, at(12), time.Time{}) {
+		t.Error("Should not compact below minimum size")
+	}
+	if !p.due(1000, 500, at(12), time.Time{}) {
+		t.Error("Should compact once dead ratio is reached")
+	}
+
+	p.MinInterval = time.Hour
+	if p.due(1000, 500, at(12), at(12).Add(-time.Minute)) || !p.due(1000, 500, at(12), at(10)) {
+		t.Error("Minimal interval is not respected")
+	}
+
+	p.WindowStart, p.WindowEnd = 22*time.Hour, 6*time.Hour
+	if p.due(1000, 500, at(12), time.Time{}) || !p.due(1000, 500, at(23), time.Time{}) || !p.due(1000, 500, at(3), time.Time{}) {
+		t.Error("Time window wrapping past midnight is not respected")
+	}
+	p.WindowStart, p.WindowEnd = 1*time.Hour, 5*time.Hour
+	if p.due(1000, 500, at(6), time.Time{}) || !p.due(1000, 500, at(2), time.Time{}) {
+		t.Error("Time window is not respected")
+	}
+
+	if (&CompactPolicy{}).due(1000, 1000, at(12), time.Time{}) {
+		t.Error("Zero policy should never compact")
+	}
+}
+
+func TestAutoCompactPolicy(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	runs := make(chan CompactRun, 10)
+	opts := Options{Compaction: CompactPolicy{
+		DeadRatio:  0.5,
+		CheckEvery: 10 * time.Millisecond,
+		Hook:       func(run CompactRun) { runs <- run },
+	}}
+	kv, err := NewSafeWithOptions(testdb, opts)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	kv.mu.Lock()
+	for i := 0; i < 20; i++ {
+		kv.Rkv.Put("key", i)
+	}
+	total, dead := kv.Rkv.sizes()
+	kv.mu.Unlock()
+	if dead <= total/2 {
+		t.Errorf("Expected live counters to show dead bytes, got %d of %d", dead, total)
+	}
+
+	select {
+	case run := <-runs:
+		if run.Err != nil || run.Reclaimed <= 0 {
+			t.Errorf("Expected successful run reclaiming bytes, got %+v", run)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Automatic compaction did not run")
+	}
+	var val int
+	if err = kv.Get("key", &val); err != nil || val != 19 {
+		t.Errorf("Expected 19 after automatic compaction, got %d, error %v", val, err)
+	}
+}
+
+func TestAutoCompactRace(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	opts := Options{MaxFileSize: 512, Compaction: CompactPolicy{DeadRatio: 0.1, CheckEvery: time.Millisecond}}
+	kv, err := NewSafeWithOptions(testdb, opts)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	// promoted Rkv functions would race with the auto compaction goroutine
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 5; j++ {
+			kv.Put("key"+strconv.Itoa(j), i)
+		}
+		if err = kv.AutoCompact(1); err != nil {
+			t.Fatalf("Error \"%q\" while compacting", err.Error())
+		}
+		if err = kv.Upgrade(); err != nil {
+			t.Fatalf("Error \"%q\" while upgrading", err.Error())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var val int
+	if err = kv.Get("key4", &val); err != nil || val != 49 {
+		t.Errorf("Expected 49, got %d, error %v", val, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	defer kv.Close()
+
+	kv.Put("one", 1)
+	kv.Put("two", 2)
+	kv.Put("two", 22)
+	kv.Put("three", 3)
+	kv.Delete("three")
+	kv.PutUntil("gone", 4, time.Now().Add(-time.Second))
+
+	s := kv.Stats()
+	if s.Keys != 3 || s.DeadRecords != 3 || s.ExpiredPending != 1 {
+		t.Errorf("Expected 3 keys, 3 dead records and 1 expired key, got %+v", s)
+	}
+	if kv.LenKeys != 3 || kv.CapKeys != 6 {
+		t.Errorf("Expected LenKeys 3 and CapKeys 6 after writes, got %d and %d", kv.LenKeys, kv.CapKeys)
+	}
+	if s.FileSize != FileHeaderSize+s.LiveBytes+s.DeadBytes || s.DeadBytes == 0 {
+		t.Errorf("Live and dead bytes do not add up to file size, got %+v", s)
+	}
+	if !s.LastCompaction.IsZero() {
+		t.Error("Store was not compacted yet")
+	}
+
+	kv.Compact()
+	s = kv.Stats()
+	if s.Keys != 2 || s.DeadRecords != 0 || s.DeadBytes != 0 || s.ExpiredPending != 0 || s.LastCompaction.IsZero() {
+		t.Errorf("Unexpected stats after compaction %+v", s)
+	}
+	stat, _ := os.Stat(testdb)
+	if s.FileSize != stat.Size() {
+		t.Errorf("Expected file size %d, got %d", stat.Size(), s.FileSize)
+	}
+
+	kv.Reopen()
+	if after := kv.Stats(); after.Keys != s.Keys || after.LiveBytes != s.LiveBytes || after.DeadBytes != 0 {
+		t.Errorf("Stats differ after reopen %+v and %+v", s, after)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	type doc struct {
+		Name  string
+		Lines []string
+	}
+	big := doc{Name: "big"}
+	for i := 0; i < 100; i++ {
+		big.Lines = append(big.Lines, "the same line of text repeated over and over")
+	}
+	flags := func(kv *Rkv, key string) uint32 {
+		_, flags, _ := kv.keydir.keys[key].readRecord(key)
+		return flags
+	}
+
+	kv, err := NewWithOptions(testdb, Options{Compression: CompressFlate})
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	kv.Put("big", big)
+	kv.Put("small", 1)
+	b := new(WriteBatch)
+	b.Put("batch", big)
+	kv.Write(b)
+	if flags(kv, "big")&flagFlate == 0 || flags(kv, "batch")&flagFlate == 0 {
+		t.Error("Large value should be compressed")
+	}
+	if flags(kv, "small")&flagFlate != 0 {
+		t.Error("Small value should not be compressed")
+	}
+	if s := kv.Stats(); s.FileSize > 1000 {
+		t.Errorf("Expected compressed file, got %d bytes", s.FileSize)
+	}
+	kv.Close()
+
+	// reopen without compression, old records stay readable and new ones are plain
+	kv, err = New(testdb)
+	if err != nil {
+		t.Fatal("Can not reopen database file")
+	}
+	defer kv.Close()
+	kv.Put("plain", big)
+	kv.PutCompressed("forced", 2)
+	b.Reset()
+	b.PutCompressed("batchforced", big)
+	kv.Write(b)
+	if flags(kv, "plain")&flagFlate != 0 || flags(kv, "batchforced")&flagFlate == 0 {
+		t.Error("Compression does not follow store options and PutCompressed")
+	}
+
+	check := func(name string) {
+		for _, key := range []string{"big", "batch", "plain", "batchforced"} {
+			var got doc
+			if err := kv.Get(key, &got); err != nil || got.Name != "big" || len(got.Lines) != 100 {
+				t.Errorf("%s: value of %q is not restored, error %v", name, key, err)
+			}
+		}
+		var small, forced int
+		kv.Get("small", &small)
+		kv.Get("forced", &forced)
+		if small != 1 || forced != 2 {
+			t.Errorf("%s: expected 1 and 2, got %d and %d", name, small, forced)
+		}
+		var buf bytes.Buffer
+		kv.ExportJSON(&buf)
+		if bytes.Count(buf.Bytes(), []byte("repeated over and over")) != 400 {
+			t.Errorf("%s: exported values are not decompressed", name)
+		}
+	}
+	check("mixed")
+	kv.Compact()
+	check("Compact")
+	if flags(kv, "big")&flagFlate == 0 || flags(kv, "plain")&flagFlate != 0 {
+		t.Error("Compact should keep records as they are stored")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	defer removeStore()
+	removeStore()
+
+	keys := &Keyring{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+	opts := Options{Keys: keys, EncryptKeys: true, MaxFileSize: 200, Compression: CompressFlate, CompressMin: 1}
+	kv, err := NewWithOptions(testdb, opts)
+	if err != nil {
+		t.Fatal("Can not open database file")
+	}
+	for i := 0; i < 10; i++ {
+		kv.Put("secretkey"+strconv.Itoa(i), "secretvalue"+strconv.Itoa(i))
+	}
+	b := new(WriteBatch)
+	b.Put("secretbatch", "secretvalue")
+	b.Delete("secretkey0")
+	kv.Write(b)
+	kv.Close()
+
+	files, _ := filepath.Glob(testdb + "*")
+	for _, name := range files {
+		data, _ := ioutil.ReadFile(name)
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("Plain text found in %s", name)
+		}
+	}
+
+	check := func(name string) {
+		var val string
+		if err := kv.Get("secretkey1", &val); err != nil || val != "secretvalue1" {
+			t.Errorf("%s: expected secretvalue1, got %q, error %v", name, val, err)
+		}
+		if kv.Exist("secretkey0") || !kv.Exist("secretbatch") {
+			t.Errorf("%s: batch is not applied", name)
+		}
+		if keys := kv.GetKeys("secretkey", -1); len(keys) != 9 {
+			t.Errorf("%s: expected 9 plain keys, got %v", name, keys)
+		}
+	}
+	kv, err = NewWithOptions(testdb, opts)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while reopening", err.Error())
+	}
+	check("reopen")
+	kv.Close()
+
+	wrong := opts
+	wrong.Keys = &Keyring{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{2}, 32)}}
+	if _, err = NewWithOptions(testdb, wrong); err != ErrWrongKey {
+		t.Error("Expected ErrWrongKey with wrong key, got", err)
+	}
+	if _, err = New(testdb); err != ErrWrongKey {
+		t.Error("Expected ErrWrongKey without keys, got", err)
+	}
+
+	// rotate keys with Compact, old key is not needed afterwards
+	keys.Keys[2] = bytes.Repeat([]byte{3}, 16)
+	keys.Current = 2
+	kv, _ = NewWithOptions(testdb, opts)
+	if err = kv.Compact(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting", err.Error())
+	}
+	kv.Close()
+	delete(keys.Keys, 1)
+	kv, err = NewWithOptions(testdb, opts)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening with rotated key", err.Error())
+	}
+	check("rotated")
+	kv.Close()
+
+	// encrypted values with plain keys still detect wrong key on open
+	removeStore()
+	opts.EncryptKeys = false
+	kv, _ = NewWithOptions(testdb, opts)
+	kv.Put("plainkey", "secretvalue")
+	kv.Close()
+	if _, err = NewWithOptions(testdb, wrong); err != ErrWrongKey {
+		t.Error("Expected ErrWrongKey for encrypted values, got", err)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	removeStore()
+	defer removeStore()
+
+	type item struct {
+		Name  string
+		Count int
+	}
+	kv, err := NewWithOptions(testdb, Options{Codec: GobCodec{}})
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening", err.Error())
+	}
+	if err = kv.Put("gob", item{"first", 1}); err != nil {
+		t.Fatalf("Error \"%q\" while putting", err.Error())
+	}
+	var it item
+	if err = kv.Get("gob", &it); err != nil || it.Name != "first" || it.Count != 1 {
+		t.Errorf("Error \"%v\" reading gob value, got %v", err, it)
+	}
+	var s string
+	if err = kv.Get("gob", &s); err == nil {
+		t.Error("Expected decoding error reading struct into string")
+	}
+
+	var buf bytes.Buffer
+	if err = kv.ExportJSON(&buf); err != nil {
+		t.Fatalf("Error \"%q\" while exporting", err.Error())
+	}
+	kv.Delete("gob")
+	if err = kv.ImportJSON(&buf); err != nil {
+		t.Fatalf("Error \"%q\" while importing", err.Error())
+	}
+	it = item{}
+	if err = kv.Get("gob", &it); err != nil || it.Name != "first" {
+		t.Errorf("Error \"%v\" reading imported gob value, got %v", err, it)
+	}
+	kv.Close()
+	removeStore()
+
+	kv, err = NewWithOptions(testdb, Options{Codec: RawCodec{}})
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening", err.Error())
+	}
+	if err = kv.Put("raw", "plain text"); err != nil {
+		t.Fatalf("Error \"%q\" while putting", err.Error())
+	}
+	if err = kv.Put("empty", []byte{}); err != nil {
+		t.Fatalf("Error \"%q\" while putting empty value", err.Error())
+	}
+	if err = kv.Put("number", 1); err != ErrRawValue {
+		t.Error("Expected ErrRawValue, got", err)
+	}
+	b := new(WriteBatch)
+	b.Put("batch", []byte("bytes"))
+	b.Put("number", 1)
+	if err = kv.Write(b); err != ErrRawValue || kv.Exist("batch") {
+		t.Error("Expected failed batch with ErrRawValue, got", err)
+	}
+	kv.Close()
+
+	kv, err = NewWithOptions(testdb, Options{Codec: RawCodec{}})
+	if err != nil {
+		t.Fatalf("Error \"%q\" while reopening", err.Error())
+	}
+	defer kv.Close()
+	var raw []byte
+	if err = kv.Get("raw", &raw); err != nil || string(raw) != "plain text" {
+		t.Errorf("Error \"%v\" reading raw value, got %q", err, raw)
+	}
+	if !kv.Exist("empty") {
+		t.Error("Empty value is lost on reopen")
+	}
+	if err = kv.Compact(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting", err.Error())
+	}
+	if err = kv.Get("empty", &raw); err != nil || len(raw) != 0 {
+		t.Errorf("Error \"%v\" reading empty value after compaction, got %q", err, raw)
+	}
+	kv.Delete("empty")
+	if kv.Exist("empty") {
+		t.Error("Empty value is not deleted")
+	}
+}
+
+func TestStore(t *testing.T) {
+	removeStore()
+	defer removeStore()
+
+	type user struct {
+		Name string
+	}
+	type order struct {
+		Total int
+	}
+	kv, err := NewSafe(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening", err.Error())
+	}
+	defer kv.Close()
+
+	users := NewStore[user](kv, "user:")
+	orders := NewStore[order](kv, "order:")
+	for i, name := range []string{"bob", "alice", "carol"} {
+		if err = users.Put(name, user{Name: name}); err != nil {
+			t.Fatalf("Error \"%q\" while putting user", err.Error())
+		}
+		orders.Put(name, order{Total: i})
+	}
+	kv.Put("user", "not in any store")
+	if err = users.Put("", user{}); err != ErrBlankKey {
+		t.Error("Expected ErrBlankKey, got", err)
+	}
+
+	u, err := users.Get("alice")
+	if err != nil || u.Name != "alice" {
+		t.Errorf("Error \"%v\" reading user, got %v", err, u)
+	}
+	if _, err = users.Get("dave"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound, got", err)
+	}
+	kv.Put("order:bad", "not an order")
+	if _, err = orders.Get("bad"); err == nil {
+		t.Error("Expected decoding error for wrong type")
+	}
+	if err = orders.Iterate(func(key string, o order) error { return nil }); err == nil {
+		t.Error("Expected decoding error while iterating")
+	}
+	orders.Delete("bad")
+
+	keys := users.Keys(-1)
+	if strings.Join(keys, ",") != "alice,bob,carol" {
+		t.Error("Unexpected user keys", keys)
+	}
+	if keys = users.Keys(2); len(keys) != 2 {
+		t.Error("Expected 2 keys with limit, got", keys)
+	}
+	total := 0
+	err = orders.Iterate(func(key string, o order) error {
+		total += o.Total
+		return nil
+	})
+	if err != nil || total != 3 {
+		t.Errorf("Error \"%v\" iterating orders, total %d", err, total)
+	}
+
+	if err = users.DeleteAll(); err != nil {
+		t.Fatalf("Error \"%q\" while deleting users", err.Error())
+	}
+	if len(users.Keys(-1)) != 0 || len(orders.Keys(-1)) != 3 || !kv.Exist("user") {
+		t.Error("DeleteAll removed keys outside of the store")
+	}
+}
+
+func TestRange(t *testing.T) {
+	removeStore()
+	defer removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening", err.Error())
+	}
+	for _, key := range []string{"d", "b", "e", "a", "c"} {
+		kv.Put(key, key)
+	}
+	kv.PutUntil("bb", 1, time.Now().Add(-time.Second))
+	kv.Close()
+
+	kv, err = New(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while reopening", err.Error())
+	}
+	defer kv.Close()
+	kv.Put("ca", 1)
+	kv.Delete("d")
+
+	check := func(name string, keys []string, expected string) {
+		if strings.Join(keys, ",") != expected {
+			t.Errorf("%s: expected %s, got %v", name, expected, keys)
+		}
+	}
+	check("GetKeys", kv.GetKeys("", -1), "a,b,c,ca,e")
+	check("Range", kv.Range("b", "e", -1), "b,c,ca")
+	check("Range limit", kv.Range("", "", 2), "a,b")
+	check("Range open end", kv.Range("bz", "", -1), "c,ca,e")
+	check("RangeReverse", kv.RangeReverse("b", "e", -1), "ca,c,b")
+	check("RangeReverse all", kv.RangeReverse("", "", 2), "e,ca")
+	if key, ok := kv.Seek("cb"); !ok || key != "e" {
+		t.Errorf("Seek: expected e, got %q", key)
+	}
+	if _, ok := kv.Seek("f"); ok {
+		t.Error("Seek: expected no key after the last one")
+	}
+
+	var buf bytes.Buffer
+	kv.ExportJSON(&buf)
+	if !strings.HasPrefix(buf.String(), "{\n \"a\" : \"a\",\n \"b\" : \"b\",\n \"c\"") {
+		t.Error("ExportJSON: keys are not ordered", buf.String())
+	}
+	keys := []string{}
+	for key := range kv.Iterator("") {
+		keys = append(keys, key)
+	}
+	check("Iterator", keys, "a,b,c,ca,e")
+
+	if err = kv.Compact(); err != nil {
+		t.Fatalf("Error \"%q\" while compacting", err.Error())
+	}
+	check("Range after compaction", kv.Range("b", "", -1), "b,c,ca,e")
+}
+
+func TestPrefix(t *testing.T) {
+	removeStore()
+	defer removeStore()
+
+	kv, err := New(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening", err.Error())
+	}
+	defer kv.Close()
+	for _, key := range []string{"user:42:name", "user:42:mail", "user:420:name", "user:4", "admin:user:42:name", "user:43:name"} {
+		kv.Put(key, 1)
+	}
+	kv.PutUntil("user:42:old", 1, time.Now().Add(-time.Second))
+
+	keys := kv.GetKeysWithPrefix("user:42:", -1)
+	if strings.Join(keys, ",") != "user:42:mail,user:42:name" {
+		t.Error("Unexpected keys with prefix", keys)
+	}
+	if keys = kv.GetKeysWithPrefix("user:42", 2); strings.Join(keys, ",") != "user:420:name,user:42:mail" {
+		t.Error("Unexpected keys with prefix and limit", keys)
+	}
+	if keys = kv.GetKeys("user:42:", -1); len(keys) != 3 {
+		t.Error("Expected substring match of GetKeys, got", keys)
+	}
+	if keys = kv.GetKeysWithPrefix("nobody", -1); len(keys) != 0 {
+		t.Error("Expected no keys, got", keys)
+	}
+
+	if err = kv.DeleteKeysWithPrefix("user:42:"); err != nil {
+		t.Fatalf("Error \"%q\" while deleting keys", err.Error())
+	}
+	if keys = kv.GetKeys("", -1); strings.Join(keys, ",") != "admin:user:42:name,user:4,user:420:name,user:43:name" {
+		t.Error("Unexpected keys after delete", keys)
+	}
+}
+
+func TestRadixTree(t *testing.T) {
+	tree := new(radixTree)
+	set := map[string]bool{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := strconv.FormatInt(rnd.Int63n(2000), 7)
+		if rnd.Intn(3) == 0 {
+			if tree.remove(key) != set[key] {
+				t.Fatalf("Remove of %q does not match the set", key)
+			}
+			delete(set, key)
+		} else {
+			if tree.insert(key) == set[key] {
+				t.Fatalf("Insert of %q does not match the set", key)
+			}
+			set[key] = true
+		}
+	}
+
+	expected := []string{}
+	for key := range set {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+	keys := []string{}
+	tree.walk("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if tree.size != len(set) || strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Tree holds %d keys, expected %d", len(keys), len(set))
+	}
+
+	for _, bound := range []string{"", "1", "12", "3", "66", "7"} {
+		i := sort.SearchStrings(expected, bound)
+		keys = keys[:0]
+		tree.walk(bound, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if strings.Join(keys, ",") != strings.Join(expected[i:], ",") {
+			t.Errorf("Walk from %q does not match", bound)
+		}
+		keys = keys[:0]
+		tree.walkReverse(bound, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if bound == "" {
+			i = len(expected)
+		}
+		if len(keys) != i || (i > 0 && keys[0] != expected[i-1]) {
+			t.Errorf("Reverse walk before %q does not match", bound)
+		}
+		prefixed := []string{}
+		for _, key := range expected {
+			if strings.HasPrefix(key, bound) {
+				prefixed = append(prefixed, key)
+			}
+		}
+		keys = keys[:0]
+		tree.walkPrefix(bound, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if strings.Join(keys, ",") != strings.Join(prefixed, ",") {
+			t.Errorf("Walk of prefix %q does not match", bound)
+		}
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	removeStore()
+	defer removeStore()
+
+	kv, err := NewSafe(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening", err.Error())
+	}
+	defer kv.Close()
+	for i := 0; i < 10; i++ {
+		kv.Put("key"+strconv.Itoa(i), i)
+	}
+	kv.Put("other", 1)
+
+	pages := []string{}
+	cursor := ""
+	for n := 0; n < 10; n++ {
+		keys, next, err := kv.ListKeys("key", cursor, 4)
+		if err != nil {
+			t.Fatalf("Error \"%q\" while listing keys", err.Error())
+		}
+		pages = append(pages, strings.Join(keys, ","))
+		if n == 0 { // writes between pages do not shift them
+			kv.Delete("key1")
+			kv.Delete("key4")
+			kv.Put("key00", 1)
+			kv.Put("key45", 1)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	expected := "key0,key1,key2,key3|key45,key5,key6,key7|key8,key9"
+	if strings.Join(pages, "|") != expected {
+		t.Errorf("Expected pages %s, got %v", expected, pages)
+	}
+
+	keys, next, err := kv.ListKeys("", "", -1)
+	if err != nil || len(keys) != 11 || next != "" {
+		t.Errorf("Error \"%v\" listing all keys, got %v and cursor %q", err, keys, next)
+	}
+	if _, _, err = kv.ListKeys("", "not a cursor!", 4); err != ErrInvalidCursor {
+		t.Error("Expected ErrInvalidCursor, got", err)
+	}
+}
+
+func TestIter(t *testing.T) {
+	removeStore()
+	defer removeStore()
+
+	kv, err := NewSafe(testdb)
+	if err != nil {
+		t.Fatalf("Error \"%q\" while opening", err.Error())
+	}
+	defer kv.Close()
+	for i := 0; i < 10; i++ {
+		kv.Put("key"+strconv.Itoa(i), i)
+	}
+	kv.Put("other", 1)
+
+	ctx := context.Background()
+	it := kv.Iter(ctx, IterOptions{Prefix: "key", Filter: func(key string) bool { return key != "key3" }})
+	keys := []string{}
+	for key, value := range it.All() {
+		if key == "key5" {
+			kv.Delete("key6") // store may be changed while iterating
+			kv.Put("key55", 1)
+		}
+		var i int
+		if err := json.Unmarshal(value, &i); err != nil || "key"+strconv.Itoa(i) != key {
+			t.Errorf("Unexpected value %s of %s", value, key)
+		}
+		keys = append(keys, key)
+	}
+	if it.Err() != nil || strings.Join(keys, ",") != "key0,key1,key2,key4,key5,key7,key8,key9" {
+		t.Errorf("Error \"%v\" iterating keys, got %v", it.Err(), keys)
+	}
+
+	count := 0
+	for range kv.Iter(ctx, IterOptions{}).All() {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Error("Expected iteration to stop after break, got", count)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	it = kv.Iter(cctx, IterOptions{})
+	count = 0
+	for range it.All() {
+		count++
+		if count == 3 {
+			cancel()
+		}
+	}
+	if count != 3 || it.Err() != context.Canceled {
+		t.Errorf("Expected iteration to stop after cancel, got %d keys and error %v", count, it.Err())
+	}
 }
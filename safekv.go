@@ -1,8 +1,10 @@
 package rkv
 
 import (
+	"context"
 	"io"
 	"sync"
+	"time"
 )
 
 // SafeRkv wraps Rkv to provide goroutine safe access to KV store.
@@ -10,6 +12,15 @@ type SafeRkv struct {
 	Rkv
     // mutex lock, only one goroutine can access KV datastore at one time
 	mu sync.Mutex
+
+	// held by compaction and by Reopen and Close, so they never overlap with CompactOnline
+	compactMu sync.Mutex
+
+	sweepStop chan struct{} // closed to stop background expiry sweep
+	sweepDone chan struct{} // closed when background expiry sweep is stopped
+
+	compactStop chan struct{} // closed to stop automatic compaction
+	compactDone chan struct{} // closed when automatic compaction is stopped
 }
 
 // Make sure SafeRkv implements our common Interface.
@@ -17,17 +28,101 @@ var _ Interface = (*SafeRkv)(nil)
 
 // NewSafe opens or creates new Rkv.
 func NewSafe(filename string) (*SafeRkv, error) {
-	kv, err := New(filename)
-	return &SafeRkv{Rkv: *kv}, err
+	return NewSafeWithOptions(filename, Options{})
+}
+
+// NewSafeWithOptions opens or creates new Rkv same as NewWithOptions.
+// With Options.SweepEvery expired keys are removed in the background and with
+// Options.Compaction store is compacted in the background until Close.
+func NewSafeWithOptions(filename string, opts Options) (*SafeRkv, error) {
+	kv := new(SafeRkv)
+	kv.init(filename, opts)
+	_, err := kv.open()
+	if err == nil {
+		kv.startSweep()
+		kv.startAutoCompact()
+	}
+	return kv, err
+}
+
+// Reopen same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Reopen() error {
+	kv.stopSweep()
+	kv.stopAutoCompact()
+	kv.compactMu.Lock()
+	defer kv.compactMu.Unlock()
+	kv.mu.Lock()
+	err := kv.Rkv.Reopen()
+	kv.mu.Unlock()
+	if err == nil {
+		kv.startSweep()
+		kv.startAutoCompact()
+	}
+	return err
+}
+
+// Close same as Rkv function but goroutine friendly, stops background expiry sweep
+// and compaction.
+func (kv *SafeRkv) Close() {
+	kv.stopSweep()
+	kv.stopAutoCompact()
+	kv.compactMu.Lock()
+	defer kv.compactMu.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.Rkv.Close()
+}
+
+// Version same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Version() uint16 {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.Version()
+}
+
+// Sync same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Sync() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.Sync()
 }
 
 // Compact same as Rkv function but goroutine friendly.
 func (kv *SafeRkv) Compact() error {
+	kv.compactMu.Lock()
+	defer kv.compactMu.Unlock()
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 	return kv.Rkv.Compact()
 }
 
+// AutoCompact same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) AutoCompact(fillRatio float64) error {
+	kv.compactMu.Lock()
+	defer kv.compactMu.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.AutoCompact(fillRatio)
+}
+
+// Upgrade same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Upgrade() error {
+	kv.compactMu.Lock()
+	defer kv.compactMu.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.Upgrade()
+}
+
+// CompactSegments same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) CompactSegments() error {
+	kv.compactMu.Lock()
+	defer kv.compactMu.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.CompactSegments()
+}
+
 // Put same as Rkv function but goroutine friendly.
 func (kv *SafeRkv) Put(key string, value interface{}) error {
 	kv.mu.Lock()
@@ -42,6 +137,20 @@ func (kv *SafeRkv) PutForDays(key string, value interface{}, days int32) error {
 	return kv.Rkv.PutForDays(key, value, days)
 }
 
+// PutWithTTL same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) PutWithTTL(key string, value interface{}, ttl time.Duration) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.PutWithTTL(key, value, ttl)
+}
+
+// PutUntil same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) PutUntil(key string, value interface{}, expire time.Time) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.PutUntil(key, value, expire)
+}
+
 // Exist same as Rkv function but goroutine friendly.
 func (kv *SafeRkv) Exist(key string) bool {
 	kv.mu.Lock()
@@ -77,6 +186,20 @@ func (kv *SafeRkv) DeleteAllKeys(with string) error {
 	return kv.Rkv.DeleteAllKeys(with)
 }
 
+// DeleteKeysWithPrefix same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) DeleteKeysWithPrefix(prefix string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.DeleteKeysWithPrefix(prefix)
+}
+
+// Write same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Write(b *WriteBatch) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.Write(b)
+}
+
 // GetKeys same as Rkv function but goroutine friendly.
 func (kv *SafeRkv) GetKeys(with string, limit int) []string {
 	kv.mu.Lock()
@@ -84,6 +207,42 @@ func (kv *SafeRkv) GetKeys(with string, limit int) []string {
 	return kv.Rkv.GetKeys(with, limit)
 }
 
+// GetKeysWithPrefix same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) GetKeysWithPrefix(prefix string, limit int) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.GetKeysWithPrefix(prefix, limit)
+}
+
+// ListKeys same as Rkv function but goroutine friendly, pages may be read while
+// other goroutines write.
+func (kv *SafeRkv) ListKeys(with, cursor string, limit int) ([]string, string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.ListKeys(with, cursor, limit)
+}
+
+// Range same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Range(start, end string, limit int) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.Range(start, end, limit)
+}
+
+// RangeReverse same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) RangeReverse(start, end string, limit int) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.RangeReverse(start, end, limit)
+}
+
+// Seek same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Seek(key string) (string, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.Seek(key)
+}
+
 // ExportJSON same as Rkv function but goroutine friendly.
 func (kv *SafeRkv) ExportJSON(w io.Writer) error {
 	kv.mu.Lock()
@@ -91,6 +250,37 @@ func (kv *SafeRkv) ExportJSON(w io.Writer) error {
 	return kv.Rkv.ExportJSON(w)
 }
 
+// ExportKeysJSON same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) ExportKeysJSON(w io.Writer, with string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.ExportKeysJSON(w, with)
+}
+
+// ExportKeyJSON same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) ExportKeyJSON(w io.Writer, key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.ExportKeyJSON(w, key)
+}
+
+// ImportJSON same as Rkv function but goroutine friendly, input is read without
+// the lock and then written with Write.
+func (kv *SafeRkv) ImportJSON(r io.Reader) error {
+	b, err := kv.Rkv.importJSON(r)
+	if err != nil {
+		return err
+	}
+	return kv.Write(b)
+}
+
+// ImportCSV same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) ImportCSV(r io.Reader, key int) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.ImportCSV(r, key)
+}
+
 // exportKeys same as Rkv function but goroutine friendly.
 func (kv *SafeRkv) exportKeys(w io.Writer, arr []string) error {
 	kv.mu.Lock()
@@ -98,7 +288,15 @@ func (kv *SafeRkv) exportKeys(w io.Writer, arr []string) error {
 	return kv.Rkv.exportKeys(w, arr)
 }
 
+// Iter same as Rkv function but goroutine friendly, the lock is held only while
+// keys are taken and while each value is read, not for the whole iteration.
+func (kv *SafeRkv) Iter(ctx context.Context, opts IterOptions) *Iter {
+	return &Iter{kv: kv, ctx: ctx, opts: opts}
+}
+
 // Iterator is unsupported in goroutines.
+//
+// Deprecated: use Iter instead.
 func (kv *SafeRkv) Iterator(with string) <-chan string {
 	panic("rkv: unsupported function on SafeRkv")
 }
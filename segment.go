@@ -0,0 +1,227 @@
+package rkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sealed segments are kept next to the active file and named after it with
+// the segment id appended, e.g. test.kv.000001, test.kv.000002 and so on.
+// Higher id means newer records, active file is always the newest.
+
+// segmentName returns file name of the sealed segment with the given id.
+func (kv *Rkv) segmentName(id int) string {
+	return fmt.Sprintf("%s.%06d", kv.filename, id)
+}
+
+// listSegments returns ids of sealed segments found on disk in ascending order.
+func (kv *Rkv) listSegments() ([]int, error) {
+	entries, err := os.ReadDir(filepath.Dir(kv.filename))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(kv.filename) + "."
+	ids := []int{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		id, err := strconv.Atoi(name[len(prefix):])
+		if err != nil || id <= 0 || kv.segmentName(id) != filepath.Join(filepath.Dir(kv.filename), name) {
+			continue // not a segment, e.g. hint or temporary file
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// openSegments opens all sealed segments for reading.
+func (kv *Rkv) openSegments() error {
+	ids, err := kv.listSegments()
+	if err != nil {
+		return err
+	}
+
+	kv.segments = nil
+	for _, id := range ids {
+		f, err := kv.openSegment(id)
+		if err != nil {
+			kv.closeSegments()
+			return err
+		}
+		kv.segments = append(kv.segments, f)
+	}
+	return nil
+}
+
+// openSegment opens single sealed segment for reading.
+func (kv *Rkv) openSegment(id int) (*GFile, error) {
+	file, err := os.Open(kv.segmentName(id))
+	if err != nil {
+		return nil, err
+	}
+	f := NewGFile(file)
+	f.id = id
+	if err = f.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// closeSegments closes all sealed segments.
+func (kv *Rkv) closeSegments() {
+	for _, f := range kv.segments {
+		f.file.Close()
+	}
+	kv.segments = nil
+}
+
+// removeSegments deletes given sealed segments from disk.
+func (kv *Rkv) removeSegments(segments []*GFile) error {
+	for _, f := range segments {
+		f.file.Close()
+		if err := kv.removeHint(f); err != nil {
+			return err
+		}
+		if err := os.Remove(kv.segmentName(f.id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollover seals the active file as the newest segment and starts new active file.
+// Keydir entries keep pointing to the same GFile, only its file handle is replaced.
+func (kv *Rkv) rollover() error {
+	id := 1
+	if n := len(kv.segments); n > 0 {
+		id = kv.segments[n-1].id + 1
+	}
+
+	f := kv.activeFile
+	name := kv.segmentName(id)
+	// sealed segment is never synced again, not even by Sync, so writes done before
+	// Sync must be flushed now regardless of SyncMode
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	if err := kv.removeHint(f); err != nil {
+		return err
+	}
+	if err := os.Rename(kv.filename, name); err != nil {
+		return err
+	}
+	if err := kv.syncRollover(); err != nil {
+		return err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	kv.syncMu.Lock()
+	f.file.Close()
+	f.file = file
+	kv.syncMu.Unlock()
+	f.id = id
+	kv.segments = append(kv.segments, f)
+	kv.scanHint(f)
+	if err := kv.openActive(); err != nil {
+		return err
+	}
+	return kv.syncRollover()
+}
+
+// syncRollover flushes the directory, so renamed segment and new active file
+// survive power loss, unless store is never synced.
+func (kv *Rkv) syncRollover() error {
+	if kv.opts.Sync == SyncNever {
+		return nil
+	}
+	return syncDir(filepath.Dir(kv.filename))
+}
+
+// CompactSegments merges all sealed segments into single segment and drops dead
+// and expired records from them, live records keep their expiry. Unlike Compact
+// the active file is not touched.
+func (kv *Rkv) CompactSegments() error {
+	kv.isReady()
+	if kv.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(kv.segments) == 0 {
+		return nil
+	}
+
+	last := kv.segments[len(kv.segments)-1]
+	name := kv.segmentName(last.id)
+	merged, err := kv.createCompacted(name, last.id)
+	if err != nil {
+		return err
+	}
+
+	sealed := map[*GFile]bool{}
+	for _, f := range kv.segments {
+		sealed[f] = true
+	}
+
+	moved := map[string]*KeydirEntry{} // nil entry drops expired key
+	now := time.Now().Unix()
+	for key, kde := range kv.keydir.keys {
+		if !sealed[kde.gfile] {
+			continue
+		}
+		if kde.expired(now) {
+			moved[key] = nil
+			continue
+		}
+		val, flags, err := kv.readRaw(key, kde)
+		if err == ErrKeyNotFound {
+			continue // corrupted record was dropped
+		}
+		if err == nil {
+			moved[key], err = kv.store(merged, key, val, flags, kde.tstamp)
+		}
+		if err != nil {
+			kv.abortCompacted(merged)
+			return err
+		}
+	}
+
+	// replace the newest segment first, older segments left by a crash after
+	// the rename are stale and removed on open
+	if err = kv.removeHint(last); err != nil {
+		kv.abortCompacted(merged)
+		return err
+	}
+	last.file.Close()
+	if err = kv.commitCompacted(merged, name); err != nil {
+		last.file, _ = os.Open(name) // keep serving the old segment
+		return err
+	}
+	if merged.file, err = os.Open(name); err != nil {
+		return err
+	}
+	kv.scanHint(merged)
+	for key, kde := range moved {
+		if kde == nil {
+			kv.keydir.remove(key)
+		} else {
+			kv.keydir.set(key, kde)
+		}
+	}
+	older := kv.segments[:len(kv.segments)-1]
+	kv.segments = []*GFile{merged}
+	err = kv.removeSegments(older)
+	kv.countKeys()
+	kv.lastCompact = time.Now()
+	return err
+}
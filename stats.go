@@ -0,0 +1,46 @@
+package rkv
+
+import (
+	"time"
+)
+
+// Stats describes current state of the store, see Rkv.Stats.
+type Stats struct {
+	Keys           int       // live keys, expired keys not yet removed included
+	DeadRecords    int       // records of overwritten, deleted and expired keys, tombstones and batch commits
+	LiveBytes      int64     // bytes taken by records of live keys
+	DeadBytes      int64     // bytes taken by dead records, reclaimed by compaction
+	FileSize       int64     // size of all data files including headers
+	ExpiredPending int       // keys expired, but not yet removed by RemoveExpired or compaction
+	LastCompaction time.Time // end of the last compaction, zero if there was none since open
+}
+
+// Stats returns current statistics of the store. Counters are kept up to date by every
+// write and compaction, only ExpiredPending is counted on every call.
+func (kv *Rkv) Stats() Stats {
+	kv.isReady()
+	s := Stats{Keys: len(kv.keydir.keys), LastCompaction: kv.lastCompact}
+	s.DeadRecords = kv.activeFile.records - s.Keys
+	s.FileSize = kv.activeFile.cpos
+	for _, f := range kv.segments {
+		s.DeadRecords += f.records
+		s.FileSize += f.cpos
+	}
+	total, dead := kv.sizes()
+	s.LiveBytes, s.DeadBytes = total-dead, dead
+
+	now := time.Now().Unix()
+	for _, kde := range kv.keydir.keys {
+		if kde.expired(now) {
+			s.ExpiredPending += 1
+		}
+	}
+	return s
+}
+
+// Stats same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) Stats() Stats {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.Stats()
+}
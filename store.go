@@ -0,0 +1,101 @@
+package rkv
+
+import (
+	"time"
+)
+
+// Store is typed view of Rkv or SafeRkv. Values of type T are kept under keys
+// starting with the store prefix, so different types in one database do not mix.
+// Keys passed to and returned by Store do not include the prefix.
+type Store[T any] struct {
+	kv     Interface
+	prefix string
+}
+
+// NewStore returns typed store of values under keys with the given prefix, e.g.
+// NewStore[User](kv, "user:"). Prefixes of stores sharing kv should not be
+// prefixes of each other.
+func NewStore[T any](kv Interface, prefix string) *Store[T] {
+	return &Store[T]{kv: kv, prefix: prefix}
+}
+
+// Prefix returns key prefix of the store.
+func (s *Store[T]) Prefix() string {
+	return s.prefix
+}
+
+// Put saves the value under key.
+func (s *Store[T]) Put(key string, value T) error {
+	if key == "" {
+		return ErrBlankKey
+	}
+	return s.kv.Put(s.prefix+key, value)
+}
+
+// PutWithTTL saves the value under key, it expires after ttl.
+func (s *Store[T]) PutWithTTL(key string, value T, ttl time.Duration) error {
+	if key == "" {
+		return ErrBlankKey
+	}
+	return s.kv.PutWithTTL(s.prefix+key, value, ttl)
+}
+
+// PutUntil saves the value under key, it expires at the given time.
+func (s *Store[T]) PutUntil(key string, value T, expire time.Time) error {
+	if key == "" {
+		return ErrBlankKey
+	}
+	return s.kv.PutUntil(s.prefix+key, value, expire)
+}
+
+// Get returns value of the key. Returns ErrKeyNotFound if there is no such key
+// and error of the codec if stored value can not be decoded as T.
+func (s *Store[T]) Get(key string) (T, error) {
+	var value T
+	err := s.kv.Get(s.prefix+key, &value)
+	return value, err
+}
+
+// Exist returns true if the key exists.
+func (s *Store[T]) Exist(key string) bool {
+	return s.kv.Exist(s.prefix + key)
+}
+
+// Delete removes the key.
+func (s *Store[T]) Delete(key string) error {
+	return s.kv.Delete(s.prefix + key)
+}
+
+// DeleteAll removes all keys of the store at once, see Write.
+func (s *Store[T]) DeleteAll() error {
+	return s.kv.DeleteKeysWithPrefix(s.prefix)
+}
+
+// Keys returns up to limit keys of the store in ascending order, all of them if
+// limit is negative.
+func (s *Store[T]) Keys(limit int) []string {
+	keys := s.kv.GetKeysWithPrefix(s.prefix, limit)
+	for i, key := range keys {
+		keys[i] = key[len(s.prefix):]
+	}
+	return keys
+}
+
+// Iterate calls fn for every key of the store in ascending order until fn returns
+// an error, which is then returned. Keys removed during iteration are skipped,
+// values that can not be decoded as T stop iteration with the codec error.
+func (s *Store[T]) Iterate(fn func(key string, value T) error) error {
+	for _, key := range s.Keys(-1) {
+		value, err := s.Get(key)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package rkv
+
+import (
+	"time"
+)
+
+// RemoveExpired removes expired keys from the keydir and returns their number.
+// Expired records in headerless version 1 files keep their expiry only with day
+// precision, so tombstones are written for them unless store is read-only.
+func (kv *Rkv) RemoveExpired() (int, error) {
+	kv.isReady()
+	now := time.Now().Unix()
+	b := new(WriteBatch)
+	removed := 0
+	for key, kde := range kv.keydir.keys {
+		if !kde.expired(now) {
+			continue
+		}
+		removed += 1
+		if kde.gfile.version == 1 && !kv.opts.ReadOnly {
+			b.Delete(key) // record would be alive again on load until the end of the day
+		} else {
+			kv.keydir.remove(key)
+		}
+	}
+	var err error
+	if b.Len() > 0 {
+		err = kv.Write(b)
+	}
+	kv.countKeys()
+	return removed, err
+}
+
+// RemoveExpired same as Rkv function but goroutine friendly.
+func (kv *SafeRkv) RemoveExpired() (int, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.Rkv.RemoveExpired()
+}
+
+// startSweep starts background removal of expired keys every Options.SweepEvery.
+func (kv *SafeRkv) startSweep() {
+	every := kv.opts.SweepEvery
+	if every <= 0 || kv.sweepStop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	kv.sweepStop, kv.sweepDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := kv.RemoveExpired(); err != nil {
+					kv.opts.logf("rkv: background expiry sweep failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopSweep stops background removal of expired keys and waits until it is done.
+func (kv *SafeRkv) stopSweep() {
+	if kv.sweepStop == nil {
+		return
+	}
+	close(kv.sweepStop)
+	<-kv.sweepDone
+	kv.sweepStop, kv.sweepDone = nil, nil
+}
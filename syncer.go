@@ -0,0 +1,76 @@
+package rkv
+
+import (
+	"time"
+)
+
+// SyncMode tells Rkv when written records are flushed to the disk with fsync.
+type SyncMode int
+
+const (
+	// SyncNever leaves flushing to the operating system, this is the default.
+	// Fastest, but acknowledged writes may be lost on power loss.
+	SyncNever SyncMode = iota
+	// SyncAlways flushes after every write, slowest but nothing is ever lost.
+	SyncAlways
+	// SyncInterval flushes in the background every Options.SyncEvery, at most
+	// this much of acknowledged writes may be lost.
+	SyncInterval
+)
+
+// DefaultSyncEvery used with SyncInterval if Options.SyncEvery is not set.
+const DefaultSyncEvery = time.Second
+
+// Sync flushes the active file to the disk, all writes done before Sync survive power loss.
+// Sealed segments are flushed once when they are sealed, so they need no further syncing.
+func (kv *Rkv) Sync() error {
+	kv.isReady()
+	return kv.syncActive()
+}
+
+// syncActive flushes the active file, safe to call from background goroutine.
+func (kv *Rkv) syncActive() error {
+	kv.syncMu.Lock()
+	defer kv.syncMu.Unlock()
+	return kv.activeFile.file.Sync()
+}
+
+// startSync starts background flushing of the active file in SyncInterval mode.
+func (kv *Rkv) startSync() {
+	if kv.opts.Sync != SyncInterval || kv.opts.ReadOnly {
+		return
+	}
+	every := kv.opts.SyncEvery
+	if every <= 0 {
+		every = DefaultSyncEvery
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	kv.syncStop, kv.syncDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := kv.syncActive(); err != nil {
+					kv.opts.logf("rkv: background sync failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopSync stops background flushing and waits until it is done.
+func (kv *Rkv) stopSync() {
+	if kv.syncStop == nil {
+		return
+	}
+	close(kv.syncStop)
+	<-kv.syncDone
+	kv.syncStop, kv.syncDone = nil, nil
+}